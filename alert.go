@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// アラート
+// syslogはSeverityを指定して送信し、MQTTはAlertトピックに送信する
+var severityMap = map[string]int{
+	"crit":    syslogCrit,
+	"err":     syslogErr,
+	"warning": syslogWarning,
+	"notice":  syslogNotice,
+	"info":    syslogInfo,
+}
+
+// parseSeverity : 設定したSeverityを検査する(空はwarning)
+func parseSeverity(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "warning"
+	}
+	if _, ok := severityMap[s]; !ok {
+		log.Fatalf("invalid severity=%s", s)
+	}
+	return s
+}
+
+func getSeverity(s string) int {
+	v, ok := severityMap[s]
+	if !ok {
+		log.Printf("unknown alert severity=%s", s)
+		return syslogWarning
+	}
+	return v
+}
+
+// sendAlert : アラートを送信する、detailはsyslogに追加する項目
+func sendAlert(a *mqttAlertDataEnt, detail string) {
+	a.Time = time.Now().Format(time.RFC3339)
+	a.Host = hostName
+	if debug {
+		log.Printf("alert %+v", a)
+	}
+	sendSyslogWithSeverity(fmt.Sprintf("type=Alert,alert=%s,event=%s,severity=%s,address=%s,name=%s,rssi=%d%s",
+		a.Type, a.Event, a.Severity, a.Address, a.Name, a.RSSI, detail), getSeverity(a.Severity))
+	publishMQTT(a)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 滞在時間と訪問の分析
+// デバイスを受信してからvisitTimeout秒受信しなくなるまでを1回の訪問とする
+// ランダムアドレスが変化した場合は関連付けたアドレスの訪問を引き継ぐ
+type VisitEnt struct {
+	Address  string
+	Enter    int64
+	Exit     int64
+	PeakRSSI int
+}
+
+type dwellBucketEnt struct {
+	Name string
+	Max  int64
+}
+
+var dwellBuckets = []dwellBucketEnt{
+	{Name: "0-1m", Max: 60},
+	{Name: "1-5m", Max: 5 * 60},
+	{Name: "5-15m", Max: 15 * 60},
+	{Name: "15-30m", Max: 30 * 60},
+	{Name: "30-60m", Max: 60 * 60},
+	{Name: "1-2h", Max: 2 * 60 * 60},
+	{Name: "2h-", Max: -1},
+}
+
+// visitMap : 訪問中のデバイス
+var visitMap = make(map[string]*VisitEnt)
+
+// closedVisits : 前回のレポート以降に終了した訪問
+var closedVisits []*VisitEnt
+
+func updateVisit(d *BluetoothDeviceEnt) {
+	if visitTimeout <= 0 || d.RSSI < visitRSSI {
+		return
+	}
+	now := time.Now().Unix()
+	id := getDeviceID(d)
+	if v, ok := visitMap[id]; ok {
+		v.Exit = now
+		v.PeakRSSI = max(v.PeakRSSI, d.RSSI)
+		return
+	}
+	visitMap[id] = &VisitEnt{
+		Address:  id,
+		Enter:    now,
+		Exit:     now,
+		PeakRSSI: d.RSSI,
+	}
+}
+
+// mergeVisit : 関連付けた前のアドレスの訪問を引き継ぐ
+func mergeVisit(prev, next string) {
+	p, ok := visitMap[prev]
+	if !ok {
+		return
+	}
+	delete(visitMap, prev)
+	if n, ok := visitMap[next]; ok {
+		n.Enter = min(n.Enter, p.Enter)
+		n.PeakRSSI = max(n.PeakRSSI, p.PeakRSSI)
+	} else {
+		visitMap[next] = p
+		p.Address = next
+	}
+}
+
+// checkVisits : 一定時間受信していない訪問を終了する
+func checkVisits() {
+	if visitTimeout <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for k, v := range visitMap {
+		if v.Exit < now-visitTimeout {
+			closedVisits = append(closedVisits, v)
+			delete(visitMap, k)
+			sendVisit(v)
+		}
+	}
+}
+
+// sendVisit : 終了した訪問毎の滞在時間と最大のRSSIを送信する
+func sendVisit(v *VisitEnt) {
+	e := &mqttVisitDataEnt{
+		Time:     time.Now().Format(time.RFC3339),
+		Host:     hostName,
+		Address:  v.Address,
+		Enter:    time.Unix(v.Enter, 0).Format(time.RFC3339),
+		Exit:     time.Unix(v.Exit, 0).Format(time.RFC3339),
+		Dwell:    v.Exit - v.Enter,
+		PeakRSSI: v.PeakRSSI,
+	}
+	if debug {
+		log.Printf("visit %+v", e)
+	}
+	sendSyslog(fmt.Sprintf("type=Visit,address=%s,enter=%s,exit=%s,dwell=%d,peakRSSI=%d",
+		e.Address, e.Enter, e.Exit, e.Dwell, e.PeakRSSI))
+	publishMQTT(e)
+}
+
+func getPercentile(s []int64, p int) int64 {
+	if len(s) < 1 {
+		return 0
+	}
+	i := (len(s)*p + 99) / 100
+	return s[max(0, min(len(s)-1, i-1))]
+}
+
+// sendAnalytics : レポート毎の訪問者数、新しい訪問の数、終了した訪問の滞在時間を送信する
+func sendAnalytics() {
+	if visitTimeout <= 0 {
+		return
+	}
+	newVisits := 0
+	for _, v := range visitMap {
+		if v.Enter > lastSendTime {
+			newVisits++
+		}
+	}
+	dwells := []int64{}
+	hist := make([]int, len(dwellBuckets))
+	sum := int64(0)
+	for _, v := range closedVisits {
+		if v.Enter > lastSendTime {
+			newVisits++
+		}
+		dw := v.Exit - v.Enter
+		dwells = append(dwells, dw)
+		sum += dw
+		for i, b := range dwellBuckets {
+			if b.Max < 0 || dw < b.Max {
+				hist[i]++
+				break
+			}
+		}
+	}
+	closedVisits = []*VisitEnt{}
+	sort.Slice(dwells, func(i, j int) bool { return dwells[i] < dwells[j] })
+	avg := 0.0
+	if len(dwells) > 0 {
+		avg = float64(sum) / float64(len(dwells))
+	}
+	e := &mqttAnalyticsDataEnt{
+		Time:      time.Now().Format(time.RFC3339),
+		Host:      hostName,
+		Active:    len(visitMap),
+		NewVisits: newVisits,
+		Visits:    len(dwells),
+		DwellAvg:  avg,
+		DwellP50:  getPercentile(dwells, 50),
+		DwellP90:  getPercentile(dwells, 90),
+		DwellP95:  getPercentile(dwells, 95),
+		Histogram: []dwellHistEnt{},
+	}
+	h := []string{}
+	for i, b := range dwellBuckets {
+		e.Histogram = append(e.Histogram, dwellHistEnt{Name: b.Name, Count: hist[i]})
+		h = append(h, fmt.Sprintf("%s:%d", b.Name, hist[i]))
+	}
+	if debug {
+		log.Printf("analytics %+v", e)
+	}
+	sendSyslog(fmt.Sprintf("type=Analytics,active=%d,newVisits=%d,visits=%d,dwellAvg=%.01f,dwellP50=%d,dwellP90=%d,dwellP95=%d,hist=%s",
+		e.Active, e.NewVisits, e.Visits, e.DwellAvg, e.DwellP50, e.DwellP90, e.DwellP95, strings.Join(h, ";")))
+	publishMQTT(e)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Appearance(AD Type 0x19)
+// bit6-15=カテゴリー bit0-5=サブカテゴリー
+// https://bitbucket.org/bluetooth-SIG/public/src/main/assigned_numbers/core/appearance_values.yaml
+type appearanceCategoryEnt struct {
+	Name string
+	Sub  map[uint16]string
+}
+
+var appearanceMap = map[uint16]appearanceCategoryEnt{
+	0x001: {Name: "Phone"},
+	0x002: {Name: "Computer", Sub: map[uint16]string{
+		0x01: "Desktop Workstation",
+		0x02: "Server-class Computer",
+		0x03: "Laptop",
+		0x04: "Handheld PC/PDA",
+		0x05: "Palm-size PC/PDA",
+		0x06: "Wearable computer",
+		0x07: "Tablet",
+		0x08: "Docking Station",
+		0x09: "All in One",
+		0x0a: "Blade Server",
+		0x0b: "Convertible",
+		0x0c: "Detachable",
+		0x0d: "IoT Gateway",
+		0x0e: "Mini PC",
+		0x0f: "Stick PC",
+	}},
+	0x003: {Name: "Watch", Sub: map[uint16]string{
+		0x01: "Sports Watch",
+		0x02: "Smartwatch",
+	}},
+	0x004: {Name: "Clock"},
+	0x005: {Name: "Display"},
+	0x006: {Name: "Remote Control"},
+	0x007: {Name: "Eye-glasses"},
+	0x008: {Name: "Tag"},
+	0x009: {Name: "Keyring"},
+	0x00a: {Name: "Media Player"},
+	0x00b: {Name: "Barcode Scanner"},
+	0x00c: {Name: "Thermometer", Sub: map[uint16]string{
+		0x01: "Ear Thermometer",
+	}},
+	0x00d: {Name: "Heart Rate Sensor", Sub: map[uint16]string{
+		0x01: "Heart Rate Belt",
+	}},
+	0x00e: {Name: "Blood Pressure", Sub: map[uint16]string{
+		0x01: "Arm Blood Pressure",
+		0x02: "Wrist Blood Pressure",
+	}},
+	0x00f: {Name: "Human Interface Device", Sub: map[uint16]string{
+		0x01: "Keyboard",
+		0x02: "Mouse",
+		0x03: "Joystick",
+		0x04: "Gamepad",
+		0x05: "Digitizer Tablet",
+		0x06: "Card Reader",
+		0x07: "Digital Pen",
+		0x08: "Barcode Scanner",
+		0x09: "Touchpad",
+		0x0a: "Presentation Remote",
+	}},
+	0x010: {Name: "Glucose Meter"},
+	0x011: {Name: "Running Walking Sensor", Sub: map[uint16]string{
+		0x01: "In-Shoe Running Walking Sensor",
+		0x02: "On-Shoe Running Walking Sensor",
+		0x03: "On-Hip Running Walking Sensor",
+	}},
+	0x012: {Name: "Cycling", Sub: map[uint16]string{
+		0x01: "Cycling Computer",
+		0x02: "Speed Sensor",
+		0x03: "Cadence Sensor",
+		0x04: "Power Sensor",
+		0x05: "Speed and Cadence Sensor",
+	}},
+	0x013: {Name: "Control Device"},
+	0x014: {Name: "Network Device"},
+	0x015: {Name: "Sensor"},
+	0x016: {Name: "Light Fixtures"},
+	0x017: {Name: "Fan"},
+	0x018: {Name: "HVAC"},
+	0x019: {Name: "Air Conditioning"},
+	0x01a: {Name: "Humidifier"},
+	0x01b: {Name: "Heating"},
+	0x01c: {Name: "Access Control"},
+	0x01d: {Name: "Motorized Device"},
+	0x01e: {Name: "Power Device"},
+	0x01f: {Name: "Light Source"},
+	0x020: {Name: "Window Covering"},
+	0x021: {Name: "Audio Sink", Sub: map[uint16]string{
+		0x01: "Standalone Speaker",
+		0x02: "Soundbar",
+		0x03: "Bookshelf Speaker",
+		0x04: "Standmounted Speaker",
+		0x05: "Speakerphone",
+	}},
+	0x022: {Name: "Audio Source", Sub: map[uint16]string{
+		0x01: "Microphone",
+		0x02: "Alarm",
+		0x03: "Bell",
+		0x04: "Horn",
+		0x05: "Broadcasting Device",
+		0x06: "Service Desk",
+		0x07: "Kiosk",
+		0x08: "Broadcasting Room",
+		0x09: "Auditorium",
+	}},
+	0x023: {Name: "Motorized Vehicle", Sub: map[uint16]string{
+		0x01: "Car",
+		0x02: "Large Goods Vehicle",
+		0x03: "2-Wheeled Vehicle",
+		0x04: "Motorbike",
+		0x05: "Scooter",
+		0x06: "Moped",
+		0x07: "3-Wheeled Vehicle",
+		0x08: "Light Vehicle",
+		0x09: "Quad Bike",
+		0x0a: "Minibus",
+		0x0b: "Bus",
+		0x0c: "Trolley",
+		0x0d: "Agricultural Vehicle",
+		0x0e: "Camper/Caravan",
+		0x0f: "Recreational Vehicle/Motor Home",
+	}},
+	0x024: {Name: "Domestic Appliance"},
+	0x025: {Name: "Wearable Audio Device", Sub: map[uint16]string{
+		0x01: "Earbud",
+		0x02: "Headset",
+		0x03: "Headphones",
+		0x04: "Neck Band",
+	}},
+	0x026: {Name: "Aircraft"},
+	0x027: {Name: "AV Equipment"},
+	0x028: {Name: "Display Equipment"},
+	0x029: {Name: "Hearing aid", Sub: map[uint16]string{
+		0x01: "In-ear hearing aid",
+		0x02: "Behind-ear hearing aid",
+		0x03: "Cochlear Implant",
+	}},
+	0x02a: {Name: "Gaming", Sub: map[uint16]string{
+		0x01: "Home Video Game Console",
+		0x02: "Portable handheld console",
+	}},
+	0x02b: {Name: "Signage"},
+	0x031: {Name: "Pulse Oximeter", Sub: map[uint16]string{
+		0x01: "Fingertip Pulse Oximeter",
+		0x02: "Wrist Worn Pulse Oximeter",
+	}},
+	0x032: {Name: "Weight Scale"},
+	0x033: {Name: "Personal Mobility Device"},
+	0x034: {Name: "Continuous Glucose Monitor"},
+	0x035: {Name: "Insulin Pump"},
+	0x036: {Name: "Medication Delivery"},
+	0x037: {Name: "Spirometer"},
+	0x051: {Name: "Outdoor Sports Activity"},
+}
+
+// getAppearanceName : Appearanceを"カテゴリー/サブカテゴリー"の名前にする
+func getAppearanceName(v uint16) string {
+	if v == 0 {
+		return ""
+	}
+	c, ok := appearanceMap[v>>6]
+	if !ok {
+		return fmt.Sprintf("unknown(0x%04x)", v)
+	}
+	s := v & 0x3f
+	if s == 0 {
+		return c.Name
+	}
+	if n, ok := c.Sub[s]; ok {
+		return c.Name + "/" + n
+	}
+	return fmt.Sprintf("%s/unknown(%d)", c.Name, s)
+}
+
+// estimateDistance : Log-distance path loss modelで距離(m)を推定する
+// 1mでの受信電力はアドバタイズされたTX Powerから41dB減衰したものとする
+// RSSIはカルマンフィルターで平滑化した値を使う
+// TX Powerがない場合は推定できないので-1を返す
+func estimateDistance(d *BluetoothDeviceEnt) float64 {
+	if !d.HasTxPower {
+		return -1
+	}
+	rssi := getFilteredRSSI(d) + float64(rssiOffset)
+	ref := float64(d.TxPower - 41)
+	return math.Pow(10, (ref-rssi)/(10*distanceFactor))
+}
+
+// getTxPowerString : syslog用のTX Power(ない場合は空)
+func getTxPowerString(d *BluetoothDeviceEnt) string {
+	if !d.HasTxPower {
+		return ""
+	}
+	return strconv.Itoa(d.TxPower)
+}
+
+// getDistanceString : syslog用の推定距離(推定できない場合は空)
+func getDistanceString(d *BluetoothDeviceEnt) string {
+	if dist := estimateDistance(d); dist >= 0 {
+		return fmt.Sprintf("%.02f", dist)
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Aranet4 CO2モニターのデータ
+// "Smart Home integration" を有効にするとManufacturer Specific Data(0x0702)で計測値を送信する
+// https://github.com/Anrijs/Aranet4-Python
+// 22     Flags (bit5=Smart Home integration)
+// 13 01 04  Version(patch,minor,major)
+// 01 00 00 00 不明
+// 1f 03  CO2 1ppm
+// c4 01  温度 0.05℃
+// 5e 27  気圧 0.1hPa
+// 2d     湿度 1%
+// 5a     バッテリー 1%
+// 01     ステータス(1=緑,2=黄,3=赤)
+// 3c 00  計測間隔 1秒
+// 1e 00  前回計測からの経過時間 1秒
+// 10     カウンター
+
+const aranetCode = 0x0702
+
+func isAranet4Data(data []byte) bool {
+	return len(data) >= 21 && data[0]&0x20 == 0x20
+}
+
+var aranetStatusNames = []string{"", "green", "yellow", "red", "blue"}
+
+func getAranetStatus(s byte) string {
+	if int(s) < len(aranetStatusNames) {
+		return aranetStatusNames[s]
+	}
+	return fmt.Sprintf("unknown(%d)", s)
+}
+
+func sendAranet4Env(d *BluetoothDeviceEnt) {
+	if !isAranet4Data(d.EnvData) {
+		return
+	}
+	co2 := int(d.EnvData[9])*256 + int(d.EnvData[8])
+	temp := float64(int(d.EnvData[11])*256+int(d.EnvData[10])) * 0.05
+	press := float64(int(d.EnvData[13])*256+int(d.EnvData[12])) * 0.1
+	hum := float64(d.EnvData[14])
+	bat := int(d.EnvData[15])
+	status := getAranetStatus(d.EnvData[16])
+	interval := int(d.EnvData[18])*256 + int(d.EnvData[17])
+	// 受信してからの経過時間も加算する
+	age := int(d.EnvData[20])*256 + int(d.EnvData[19]) + int(time.Now().Unix()-d.LastTime)
+	if debug {
+		log.Printf("aranet4 co2=%d,temp=%.02f,hum=%.02f,press=%.02f,bat=%d,status=%s,interval=%d,age=%d",
+			co2, temp, hum, press, bat, status, interval, age)
+	}
+	e := &mqttEnvDataEnt{
+		Time:        time.Now().Format(time.RFC3339),
+		Host:        hostName,
+		Address:     d.Address,
+		Name:        d.Name,
+		Type:        "Aranet4Env",
+		RSSI:        d.RSSI,
+		Temperature: temp,
+		Humidity:    hum,
+		Co2:         co2,
+		Battery:     bat,
+		Pressure:    press,
+		Status:      status,
+		Interval:    interval,
+		Age:         age,
+	}
+	values := getEnvValues(e, "temperature", "humidity", "co2", "pressure", "battery")
+	values["status"] = float64(d.EnvData[16])
+	if !checkSensorData(d, e.Type, values) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=Aranet4Env,address=%s,name=%s,rssi=%d,temp=%.02f,hum=%.02f,co2=%d,press=%.02f,bat=%d,status=%s,interval=%d,age=%d",
+		d.Address, d.Name, d.RSSI,
+		temp, hum, co2, press, bat, status, interval, age,
+	))
+	publishMQTT(e)
+}
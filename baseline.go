@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"time"
+)
+
+// 学習したベースラインからの逸脱の検知
+// learnPeriod時間の間、時間帯(0-23時)毎にデバイス、ベンダー、分類、デバイス数を記録して
+// その後は新しいベンダー、通常と異なるデバイス数、通常いない時間帯のデバイスを
+// 点数(0-100)付きのanomalyアラートとして送信する
+type BaselineHourEnt struct {
+	Samples    int            `json:"samples"`
+	Sum        float64        `json:"sum"`
+	SumSq      float64        `json:"sum_sq"`
+	Categories map[string]int `json:"categories"`
+}
+
+type BaselineEnt struct {
+	Start   int64              `json:"start"`
+	End     int64              `json:"end"`
+	Vendors map[string]int     `json:"vendors"`
+	Devices map[string]uint32  `json:"devices"`
+	Hours   []*BaselineHourEnt `json:"hours"`
+}
+
+var baseline *BaselineEnt
+
+// baselineChanged : 学習後にアラートを送信したベンダーや分類を追加した
+var baselineChanged = false
+
+// anomalyAlerted : 同じ逸脱を繰り返し送信しないための記録(時間帯が変わるとリセット)
+var anomalyAlerted = make(map[string]bool)
+var anomalyHour = -1
+
+func newBaseline() *BaselineEnt {
+	b := &BaselineEnt{
+		Start:   time.Now().Unix(),
+		Vendors: make(map[string]int),
+		Devices: make(map[string]uint32),
+	}
+	for i := 0; i < 24; i++ {
+		b.Hours = append(b.Hours, &BaselineHourEnt{Categories: make(map[string]int)})
+	}
+	return b
+}
+
+func loadBaseline() {
+	if baselineFile == "" {
+		return
+	}
+	baseline = newBaseline()
+	b, err := os.ReadFile(baselineFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("load baseline err=%v", err)
+		}
+		log.Printf("start learning baseline period=%dh", learnPeriod)
+		return
+	}
+	if err := json.Unmarshal(b, baseline); err != nil || len(baseline.Hours) != 24 {
+		log.Fatalf("load baseline err=%v", err)
+	}
+	for _, h := range baseline.Hours {
+		if h.Categories == nil {
+			h.Categories = make(map[string]int)
+		}
+	}
+	if baseline.End == 0 {
+		log.Printf("continue learning baseline start=%s", time.Unix(baseline.Start, 0).Format(time.RFC3339))
+	}
+}
+
+func saveBaseline() {
+	if baseline == nil {
+		return
+	}
+	b, err := json.Marshal(baseline)
+	if err != nil {
+		log.Printf("save baseline err=%v", err)
+		return
+	}
+	tmp := baselineFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("save baseline err=%v", err)
+		return
+	}
+	if err := os.Rename(tmp, baselineFile); err != nil {
+		log.Printf("save baseline err=%v", err)
+	}
+}
+
+// getAnomalyHour : 現在の時間帯、時間帯が変わったら送信済みの記録をリセットする
+func getAnomalyHour() int {
+	hour := time.Now().Hour()
+	if hour != anomalyHour {
+		anomalyAlerted = make(map[string]bool)
+		anomalyHour = hour
+	}
+	return hour
+}
+
+func isLearning() bool {
+	return baseline != nil && baseline.End == 0
+}
+
+// checkBaseline : 前回のレポート以降に受信したデバイスを学習または検査する
+func checkBaseline(d *BluetoothDeviceEnt) {
+	if baseline == nil {
+		return
+	}
+	hour := getAnomalyHour()
+	vendor := getVendor(d)
+	// ローテーションするランダムアドレスは記録しない
+	track := d.FixedAddr || d.Identity != ""
+	if isLearning() {
+		if vendor != "" {
+			baseline.Vendors[vendor]++
+		}
+		baseline.Hours[hour].Categories[d.Category]++
+		if track {
+			baseline.Devices[getDeviceID(d)] |= 1 << hour
+		}
+		return
+	}
+	if vendor != "" {
+		if _, ok := baseline.Vendors[vendor]; !ok {
+			// 一度送信したら学習済みとする
+			baseline.Vendors[vendor] = 1
+			baselineChanged = true
+			sendAnomaly(d, "new_vendor", 70, 0, 0, fmt.Sprintf(",vendor=%s", vendor))
+		}
+	}
+	if _, ok := baseline.Hours[hour].Categories[d.Category]; !ok {
+		baseline.Hours[hour].Categories[d.Category] = 1
+		baselineChanged = true
+		sendAnomaly(d, "new_category", 50, 0, 0, fmt.Sprintf(",category=%s,hour=%d", d.Category, hour))
+	}
+	if !track {
+		return
+	}
+	id := getDeviceID(d)
+	if m, ok := baseline.Devices[id]; ok && m&(1<<hour) == 0 && !anomalyAlerted["device:"+id] {
+		anomalyAlerted["device:"+id] = true
+		// 普段いる時間帯が少ないほど点数を高くする
+		n := bits.OnesCount32(m)
+		sendAnomaly(d, "outside_hours", 100-2*n, 0, 0, fmt.Sprintf(",hour=%d,usualHours=%d", hour, n))
+	}
+}
+
+// checkBaselineCount : レポート毎のデバイス数を学習または検査する
+// 学習期間が終わったらベースラインを確定する
+func checkBaselineCount(active int) {
+	if baseline == nil {
+		return
+	}
+	h := baseline.Hours[getAnomalyHour()]
+	v := float64(active)
+	if baselineChanged {
+		baselineChanged = false
+		saveBaseline()
+	}
+	if isLearning() {
+		h.Samples++
+		h.Sum += v
+		h.SumSq += v * v
+		if time.Now().Unix() >= baseline.Start+int64(learnPeriod)*60*60 {
+			baseline.End = time.Now().Unix()
+			log.Printf("end learning baseline vendors=%d devices=%d", len(baseline.Vendors), len(baseline.Devices))
+		}
+		saveBaseline()
+		return
+	}
+	if h.Samples < 3 {
+		return
+	}
+	mean := h.Sum / float64(h.Samples)
+	sd := math.Max(1.0, math.Sqrt(math.Max(0, h.SumSq/float64(h.Samples)-mean*mean)))
+	z := math.Abs(v-mean) / sd
+	if z < 3 || anomalyAlerted["count"] {
+		return
+	}
+	anomalyAlerted["count"] = true
+	score := min(100, int(z*20))
+	sendAnomaly(nil, "unusual_count", score, v, mean, fmt.Sprintf(",count=%d,expected=%.01f,z=%.02f", active, mean, z))
+}
+
+func sendAnomaly(d *BluetoothDeviceEnt, reason string, score int, value, expected float64, detail string) {
+	a := &mqttAlertDataEnt{
+		Type:     "anomaly",
+		Event:    reason,
+		Severity: "notice",
+		Score:    score,
+		Expected: expected,
+	}
+	if expected != 0 {
+		a.Value = &value
+	}
+	if score >= 80 {
+		a.Severity = "warning"
+	}
+	if d != nil {
+		a.Address = d.Address
+		a.Name = d.Name
+		a.RSSI = d.RSSI
+		a.Vendor = getVendor(d)
+		a.Category = d.Category
+	}
+	sendAlert(a, fmt.Sprintf(",score=%d%s", score, detail))
+}
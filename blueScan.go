@@ -5,37 +5,66 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
 )
 
 type BluetoothDeviceEnt struct {
-	Address     string
-	AddressType string
-	Name        string
-	FixedAddr   bool
-	MinRSSI     int
-	MaxRSSI     int
-	RSSI        int
-	Info        string
-	Count       int
-	Code        uint16
-	SBType      uint8
-	EnvData     []byte
-	UUIDMap     map[string]bool
-	FirstTime   int64
-	LastTime    int64
+	Address      string
+	AddressType  string
+	Name         string
+	FixedAddr    bool
+	MinRSSI      int
+	MaxRSSI      int
+	RSSI         int
+	Info         string
+	Count        int
+	Code         uint16
+	SBType       uint8
+	SBData       []byte
+	EnvData      []byte
+	UUIDMap      map[string]bool
+	Appearance   uint16
+	TxPower      int
+	HasTxPower   bool
+	IBeacon      bool
+	Category     string
+	Confidence   int
+	Identity     string
+	RPA          string
+	Rotations    int
+	MfgPrefix    []byte
+	FirstRSSI    int
+	Interval     int64
+	LastMilli    int64
+	Prev         string
+	Next         string
+	ChainID      string
+	Present      bool
+	ArriveTime   int64
+	WeakSince    int64
+	RSSIStats    RSSIStatsEnt
+	BeaconID     string
+	RogueSince   int64
+	RogueLast    int64
+	RogueAlerted bool
+	FirstTime    int64
+	LastTime     int64
 }
 
 func (d *BluetoothDeviceEnt) String() string {
-	return fmt.Sprintf("type=Device,address=%s,name=%s,rssi=%d,min=%d,max=%d,addrType=%s,vendor=%s,info=%s,uuid=%s,ft=%s,lt=%s",
+	return fmt.Sprintf("type=Device,address=%s,name=%s,rssi=%d,min=%d,max=%d,addrType=%s,vendor=%s,info=%s,uuid=%s,uuidName=%s,appearance=%s,txPower=%s,distance=%s,category=%s,confidence=%d,identity=%s,rpa=%s,rotations=%d,chain=%s,samples=%d,mean=%.01f,median=%d,stddev=%.02f,ema=%.01f,filtered=%.01f,ft=%s,lt=%s",
 		d.Address, d.Name, d.RSSI, d.MinRSSI, d.MaxRSSI,
-		d.AddressType, getVendor(d), d.Info, getUUID(d),
+		d.AddressType, getVendor(d), d.Info, getUUID(d), getUUIDNames(d),
+		getAppearanceName(d.Appearance), getTxPowerString(d), getDistanceString(d), d.Category, d.Confidence,
+		d.Identity, d.RPA, d.Rotations, d.ChainID,
+		d.RSSIStats.Count, d.RSSIStats.mean(), d.RSSIStats.median(), d.RSSIStats.stddev(),
+		d.RSSIStats.EMA, getFilteredRSSI(d),
 		time.Unix(d.FirstTime, 0).Format(time.RFC3339),
 		time.Unix(d.LastTime, 0).Format(time.RFC3339),
 	)
@@ -74,16 +103,26 @@ func startBlueScan(ctx context.Context) {
 		log.Fatalf("start bluescan err=%v", err)
 	}
 	log.Println("start bluescan")
+	loadInventory()
 	timer := time.NewTicker(time.Second * time.Duration(syslogInterval))
 	defer timer.Stop()
+	check := time.NewTicker(time.Second * 10)
+	defer check.Stop()
 	for {
 		select {
 		case report := <-reportCh:
 			checkBlueDevice(report)
+		case <-check.C:
+			correlateAddresses()
+			checkDeparture()
+			checkVisits()
+			checkUniqueCount()
+			sendSwitchBotSensorReport(true)
 		case <-timer.C:
 			sendMonitor()
 			sendReport()
 		case <-ctx.Done():
+			saveInventory()
 			h.StopScanning()
 			h.Deinit()
 			log.Println("stop bluetooth scan")
@@ -100,10 +139,30 @@ func checkBlueDevice(r *host.ScanReport) {
 	}
 	total++
 	now := time.Now().Unix()
+	milli := time.Now().UnixMilli()
 	addr := r.Address.String()
-	if v, ok := deviceMap.Load(addr); ok {
+	// IRKで解決できたRPAはIDでまとめる(Addressは受信したアドレスのまま)
+	key := addr
+	id := resolveAddress(r.Address)
+	if id != "" {
+		key = id
+	}
+	if v, ok := deviceMap.Load(key); ok {
 		if d, ok := v.(*BluetoothDeviceEnt); ok {
+			if id != "" && d.RPA != addr {
+				d.Address = addr
+				d.RPA = addr
+				d.Rotations++
+			}
 			d.RSSI = rssi
+			d.RSSIStats.add(rssi)
+			// スキャンレスポンスを除いた受信間隔の最小値をアドバタイズ間隔とする
+			if r.Type != hci.ScanRsp {
+				if diff := milli - d.LastMilli; d.LastMilli > 0 && diff > 0 && (d.Interval == 0 || diff < d.Interval) {
+					d.Interval = diff
+				}
+				d.LastMilli = milli
+			}
 			if d.RSSI > d.MaxRSSI {
 				d.MaxRSSI = d.RSSI
 			}
@@ -113,9 +172,13 @@ func checkBlueDevice(r *host.ScanReport) {
 			checkDeviceInfo(d, r)
 			d.Count++
 			d.LastTime = now
+			checkArrival(d)
+			updateVisit(d)
+			checkRogue(d)
+			decodeSensorData(d)
 			return
 		} else {
-			deviceMap.Delete(addr)
+			deviceMap.Delete(key)
 		}
 	}
 	d := &BluetoothDeviceEnt{
@@ -123,13 +186,25 @@ func checkBlueDevice(r *host.ScanReport) {
 		RSSI:      int(r.Rssi),
 		MinRSSI:   int(r.Rssi),
 		MaxRSSI:   int(r.Rssi),
+		FirstRSSI: int(r.Rssi),
+		LastMilli: milli,
 		Count:     1,
 		UUIDMap:   make(map[string]bool),
 		FirstTime: now,
 		LastTime:  now,
 	}
+	if id != "" {
+		d.Identity = id
+		d.RPA = addr
+	}
+	d.RSSIStats.add(rssi)
+	restoreInventory(d)
 	checkDeviceInfo(d, r)
-	deviceMap.Store(addr, d)
+	deviceMap.Store(key, d)
+	checkArrival(d)
+	updateVisit(d)
+	checkRogue(d)
+	decodeSensorData(d)
 }
 
 func getVendor(d *BluetoothDeviceEnt) string {
@@ -138,7 +213,14 @@ func getVendor(d *BluetoothDeviceEnt) string {
 			return fmt.Sprintf("%s(0x%04x)", v, d.Code)
 		}
 	}
-	return getVendorFromAddress(d.Address)
+	// 公開アドレスのOUIを優先して、ランダムアドレスまたは不明な場合はメンバーUUIDから推定する
+	v := getVendorFromAddress(d.Address)
+	if !strings.HasPrefix(d.AddressType, "LE Public") || v == "Unknown" {
+		if u := getVendorFromUUID(d); u != "" {
+			return u
+		}
+	}
+	return v
 }
 
 func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
@@ -161,11 +243,18 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 				continue
 			}
 			code = uint16(a.Data[1])*256 + uint16(a.Data[0])
+			d.MfgPrefix = a.Data[:min(len(a.Data), 4)]
 
 			// InkbirdセンサーはManufacturer ID領域に環境データを格納するため、
 			// 偶然他のメーカーコード（AppleやGarminなど）と一致してスキップされるのを防ぎ、
 			// 同時に d.Code が温度データで書き換わるのを防ぐため code=0 をセットする
-			if isInkbird(d.Name) || isInkbird(name) {
+			if isInkbirdBBQ(d.Name) || isInkbirdBBQ(name) {
+				if len(a.Data) >= 12 && len(a.Data)%2 == 0 {
+					d.EnvData = a.Data
+					code = 0
+					d.Code = 0
+				}
+			} else if isInkbird(d.Name) || isInkbird(name) {
 				if len(a.Data) == 9 || len(a.Data) == 18 || len(a.Data) == 19 || (len(a.Data) == 17 && a.Data[0] == 0x54 && a.Data[1] == 0x32) {
 					d.EnvData = a.Data
 					code = 0
@@ -174,8 +263,10 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 			}
 
 			switch code {
-			case 0x02d5:
-				if len(a.Data) >= 18 {
+			case omronCode:
+				if len(a.Data) > 2 && a.Data[2] != omronDataSensor {
+					checkOMRONData(d, a.Data[2:])
+				} else if len(a.Data) >= 18 {
 					d.EnvData = a.Data[2:]
 				}
 			case 0x0969:
@@ -185,9 +276,27 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 					// SwitchBot Plug Mini
 					// https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/blob/latest/devicetypes/plugmini.md
 					d.EnvData = a.Data[9:]
+				} else if len(a.Data) >= 11 {
+					// Blind Tilt, Lock
+					d.EnvData = a.Data[9:]
+				}
+			case aranetCode:
+				if isAranet4Data(a.Data[2:]) {
+					d.EnvData = a.Data[2:]
 				}
-			case 0x004c, 0x0006:
-				// Apple and MS Skip
+			case mopekaCode:
+				if isMopekaData(a.Data[2:]) {
+					d.EnvData = a.Data[2:]
+					checkMopekaLevel(d)
+				}
+			case 0x004c:
+				// iBeacon
+				if id := getIBeaconID(a.Data); id != "" {
+					d.IBeacon = true
+					d.BeaconID = id
+				}
+			case 0x0006:
+				// MS Skip
 			case 0x1c03, 0x1d03:
 				// data=031c71105d139c04e5ac2655f52ed242
 				// Bose Skip
@@ -201,20 +310,65 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 				}
 			}
 		case hci.AdTxPower:
+			if len(a.Data) == 1 {
+				d.TxPower = int(int8(a.Data[0]))
+				d.HasTxPower = true
+			}
+		case hci.AdAppearance:
+			if len(a.Data) == 2 {
+				d.Appearance = uint16(a.Data[1])<<8 | uint16(a.Data[0])
+			}
 		case hci.AdComplete128BitService, hci.AdMore128BitService:
-			if id, err := uuid.FromBytes(a.Data); err == nil {
-				d.UUIDMap[id.String()] = true
+			for _, id := range parseUUIDList(a.Data, 16) {
+				d.UUIDMap[id] = true
+			}
+		case hci.AdComplete32BitService, hci.AdMore32BitService:
+			for _, id := range parseUUIDList(a.Data, 4) {
+				d.UUIDMap[id] = true
 			}
 		case hci.AdComplete16BitService, hci.AdMore16BitService:
-			if len(a.Data) == 2 {
-				id := uint16(a.Data[1])*256 + uint16(a.Data[0])
-				d.UUIDMap[fmt.Sprintf("%04x", id)] = true
+			for _, id := range parseUUIDList(a.Data, 2) {
+				d.UUIDMap[id] = true
+			}
+		case hci.Ad16bitServiceSol:
+			for _, id := range parseUUIDList(a.Data, 2) {
+				d.UUIDMap["sol:"+id] = true
+			}
+		case hci.Ad32BitServiceSol:
+			for _, id := range parseUUIDList(a.Data, 4) {
+				d.UUIDMap["sol:"+id] = true
+			}
+		case hci.Ad128bitServiceSol:
+			for _, id := range parseUUIDList(a.Data, 16) {
+				d.UUIDMap["sol:"+id] = true
+			}
+		case hci.AdServiceData32:
+			if len(a.Data) >= 4 {
+				d.UUIDMap[parseUUIDList(a.Data[:4], 4)[0]] = true
+			}
+		case hci.AdServiceData128:
+			if len(a.Data) >= 16 {
+				d.UUIDMap[parseUUIDList(a.Data[:16], 16)[0]] = true
 			}
 		case hci.AdServiceData:
+			if len(a.Data) >= 2 {
+				d.UUIDMap[parseUUIDList(a.Data[:2], 2)[0]] = true
+			}
+			if id := getEddystoneID(a.Data); id != "" {
+				d.BeaconID = id
+			}
+			if checkMeshServiceData(d, a.Data) {
+				continue
+			}
+			if len(a.Data) > 3 && a.Data[0] == 0x3d && a.Data[1] == 0xfd {
+				d.SBData = a.Data
+			}
 			if len(a.Data) == 8 && a.Data[0] == 0 && a.Data[1] == 0x0d && a.Data[2] == 0x54 {
 				d.EnvData = a.Data[:]
 			} else if len(a.Data) == 8 && a.Data[0] == 0xf1 && a.Data[1] == 0xff {
 				d.EnvData = a.Data[:]
+			} else if isQingpingData(a.Data) {
+				d.EnvData = a.Data[:]
 			} else if r.Type == hci.ScanRsp && len(a.Data) == 8 && a.Data[0] == 0x3d &&
 				a.Data[1] == 0xfd && a.Data[2] == 0x73 {
 				// Motion Sensor Broadcast
@@ -250,18 +404,31 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 					motionSensorMap.Store(addr, ms)
 					sendMotionSensor(ms, "new")
 				}
-				d.SBType = 0x73 //
+				d.SBType = sbTypeMotion
+			} else if isSwitchBotServiceData(a.Data, sbTypeContact) {
+				checkSwitchBotContact(d, a.Data)
+				d.SBType = sbTypeContact
+			} else if isSwitchBotServiceData(a.Data, sbTypePresence) {
+				checkSwitchBotPresence(d, a.Data)
+				d.SBType = sbTypePresence
 			} else {
-				if d.Code == 0x0969 && len(a.Data) > 3 && a.Data[0] == 0x3d &&
-					a.Data[1] == 0xfd {
-					d.SBType = a.Data[2]
+				if len(a.Data) > 3 && a.Data[0] == 0x3d && a.Data[1] == 0xfd {
+					d.SBType = a.Data[2] & 0x7f
 				} else {
 					if debug {
 						log.Printf("AdServiceData d=%+v data=%x", d, a.Data)
 					}
 				}
 			}
-		case hci.AdAppearance, hci.AdSlaveConnInterval:
+		case hci.AdMeshBeacon:
+			checkMeshBeacon(d, a.Data)
+		case hci.AdMeshMessage:
+			checkMeshMessage(d, a.Data)
+		case hci.AdMeshPbAdv:
+			updateMeshNode(d, func(n *MeshNodeEnt) {
+				n.State = "provisioning"
+			})
+		case hci.AdSlaveConnInterval:
 			// Skip
 		default:
 			if debug {
@@ -278,6 +445,12 @@ func checkDeviceInfo(d *BluetoothDeviceEnt, r *host.ScanReport) {
 	if code != 0x0000 {
 		d.Code = code
 	}
+	if d.Code == switchBotCode && d.SBType == sbTypeLeak {
+		checkSwitchBotLeak(d)
+	}
+	if isSwitchBotActuator(d.SBType) {
+		checkSwitchBotActuator(d, d.SBData)
+	}
 }
 
 var flagNames = []struct {
@@ -338,7 +511,8 @@ func setAddrType(d *BluetoothDeviceEnt, addr hci.BtAddress) {
 // c3 01  二酸化炭素 1ppm
 // ff
 
-func sendOMRONEnv(d *BluetoothDeviceEnt) {
+// sendOMRONEnv : 送信した場合はtrueを返す
+func sendOMRONEnv(d *BluetoothDeviceEnt) bool {
 	seq := int(d.EnvData[1])
 	temp := float64(int(d.EnvData[3])*256+int(d.EnvData[2])) * 0.01
 	hum := float64(int(d.EnvData[5])*256+int(d.EnvData[4])) * 0.01
@@ -351,17 +525,14 @@ func sendOMRONEnv(d *BluetoothDeviceEnt) {
 		log.Printf("omron seq=%d,temp=%.02f,hum=%.02f,lx=%d,press=%.02f,sound=%.02f,eTVOC=%d,eCO2=%d",
 			seq, temp, hum, lx, press, sound, v, co2)
 	}
-	sendSyslog(fmt.Sprintf("type=OMRONEnv,address=%s,name=%s,rssi=%d,seq=%d,temp=%.02f,hum=%.02f,lx=%d,press=%.02f,sound=%.02f,eTVOC=%d,eCO2=%d",
-		d.Address, d.Name, d.RSSI,
-		seq, temp, hum, lx, press, sound, v, co2,
-	))
-	publishMQTT(&mqttEnvDataEnt{
+	e := &mqttEnvDataEnt{
 		Time:        time.Now().Format(time.RFC3339),
 		Host:        hostName,
 		Address:     d.Address,
 		Name:        d.Name,
 		Type:        "OMRONEnv",
 		RSSI:        d.RSSI,
+		Battery:     -1,
 		Temperature: temp,
 		Humidity:    hum,
 		Co2:         co2,
@@ -369,35 +540,58 @@ func sendOMRONEnv(d *BluetoothDeviceEnt) {
 		Pressure:    press,
 		Sound:       sound,
 		TVOC:        v,
-	})
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "temperature", "humidity", "co2", "pressure", "sound", "tvoc", "lux")) {
+		return false
+	}
+	sendSyslog(fmt.Sprintf("type=OMRONEnv,address=%s,name=%s,rssi=%d,seq=%d,temp=%.02f,hum=%.02f,lx=%d,press=%.02f,sound=%.02f,eTVOC=%d,eCO2=%d",
+		d.Address, d.Name, d.RSSI,
+		seq, temp, hum, lx, press, sound, v, co2,
+	))
+	publishMQTT(e)
+	return true
 }
 
 // 0x00 0d 54 10 e4 07 9a 37
+// Meter Plus(0x3dfd 69)も同じ形式
 func sendSwitchBotEnv(d *BluetoothDeviceEnt) {
-	bat := int(d.EnvData[4] & 0x7f)
-	temp := float64(int(d.EnvData[5]&0x0f))/10.0 + float64(d.EnvData[6]&0x7f)
-	if (d.EnvData[6] & 0x80) != 0x80 {
+	data := d.EnvData
+	if d.SBType != 0 {
+		data = d.SBData
+	}
+	if len(data) < 8 {
+		return
+	}
+	model := getSwitchBotModelName(d)
+	bat := int(data[4] & 0x7f)
+	temp := float64(int(data[5]&0x0f))/10.0 + float64(data[6]&0x7f)
+	if (data[6] & 0x80) != 0x80 {
 		temp *= -1.0
 	}
-	hum := float64(int(d.EnvData[7] & 0x7f))
+	hum := float64(int(data[7] & 0x7f))
 	if debug {
-		log.Printf("switchbot temp=%.02f,hum=%.02f,bat=%d", temp, hum, bat)
+		log.Printf("switchbot model=%s,temp=%.02f,hum=%.02f,bat=%d", model, temp, hum, bat)
 	}
-	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,temp=%.02f,hum=%.02f,bat=%d",
-		d.Address, d.Name, d.RSSI,
-		temp, hum, bat,
-	))
-	publishMQTT(&mqttEnvDataEnt{
+	e := &mqttEnvDataEnt{
 		Time:        time.Now().Format(time.RFC3339),
 		Host:        hostName,
 		Address:     d.Address,
 		Name:        d.Name,
 		Type:        "SwitchBotEnv",
+		Model:       model,
 		RSSI:        d.RSSI,
 		Temperature: temp,
 		Humidity:    hum,
 		Battery:     bat,
-	})
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "temperature", "humidity", "battery")) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,model=%s,temp=%.02f,hum=%.02f,bat=%d",
+		d.Address, d.Name, d.RSSI, model,
+		temp, hum, bat,
+	))
+	publishMQTT(e)
 }
 
 // 64 009d 2d 0301000000
@@ -412,32 +606,41 @@ func sendSwitchBotCo2(d *BluetoothDeviceEnt) {
 	}
 	hum := float64(int(d.EnvData[3] & 0x7f))
 	co2 := int(d.EnvData[6])*256 + int(d.EnvData[7])
+	model := getSwitchBotModelName(d)
 	if debug {
-		log.Printf("switchbot temp=%.02f,hum=%.02f,co2=%d,bat=%d", temp, hum, co2, bat)
+		log.Printf("switchbot model=%s,temp=%.02f,hum=%.02f,co2=%d,bat=%d", model, temp, hum, co2, bat)
 	}
-	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,temp=%.02f,hum=%.02f,co2=%d,bat=%d",
-		d.Address, d.Name, d.RSSI,
-		temp, hum, co2, bat,
-	))
-	publishMQTT(&mqttEnvDataEnt{
+	e := &mqttEnvDataEnt{
 		Time:        time.Now().Format(time.RFC3339),
 		Host:        hostName,
 		Address:     d.Address,
 		Name:        d.Name,
 		Type:        "SwitchBotEnv",
+		Model:       model,
 		RSSI:        d.RSSI,
 		Temperature: temp,
 		Humidity:    hum,
 		Co2:         co2,
 		Battery:     bat,
-	})
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "temperature", "humidity", "co2", "battery")) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,model=%s,temp=%.02f,hum=%.02f,co2=%d,bat=%d",
+		d.Address, d.Name, d.RSSI, model,
+		temp, hum, co2, bat,
+	))
+	publishMQTT(e)
 }
 
 // 0e 099c 29 00
+// Outdoor Meter(IP64),Meter Pro,Meter Plusの
+// Manufacturer Specific Dataも同じ形式
 func sendSwitchBotIP64(d *BluetoothDeviceEnt) {
 	if len(d.EnvData) < 5 {
 		return
 	}
+	model := getSwitchBotModelName(d)
 	bat := int(d.EnvData[0] & 0x7f)
 	temp := float64(int(d.EnvData[1]&0x0f))/10.0 + float64(d.EnvData[2]&0x7f)
 	if (d.EnvData[2] & 0x80) != 0x80 {
@@ -445,47 +648,65 @@ func sendSwitchBotIP64(d *BluetoothDeviceEnt) {
 	}
 	hum := float64(int(d.EnvData[3] & 0x7f))
 	if debug {
-		log.Printf("switchbot temp=%.02f,hum=%.02f,bat=%d", temp, hum, bat)
+		log.Printf("switchbot model=%s,temp=%.02f,hum=%.02f,bat=%d", model, temp, hum, bat)
 	}
-	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,temp=%.02f,hum=%.02f,bat=%d",
-		d.Address, d.Name, d.RSSI,
-		temp, hum, bat,
-	))
-	publishMQTT(&mqttEnvDataEnt{
+	e := &mqttEnvDataEnt{
 		Time:        time.Now().Format(time.RFC3339),
 		Host:        hostName,
 		Address:     d.Address,
 		Name:        d.Name,
 		Type:        "SwitchBotEnv",
+		Model:       model,
 		RSSI:        d.RSSI,
 		Temperature: temp,
 		Humidity:    hum,
 		Battery:     bat,
-	})
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "temperature", "humidity", "battery")) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,model=%s,temp=%.02f,hum=%.02f,bat=%d",
+		d.Address, d.Name, d.RSSI, model,
+		temp, hum, bat,
+	))
+	publishMQTT(e)
 }
 
 func sendSwitchBotPlugMini(d *BluetoothDeviceEnt) {
+	if len(d.EnvData) < 5 {
+		return
+	}
+	model := getSwitchBotModelName(d)
 	sw := d.EnvData[0] == 0x80
 	over := (d.EnvData[3] & 0x80) == 0x80
 	load := int(d.EnvData[3]&0x7f)*256 + int(d.EnvData[4]&0x7f)
 	if debug {
-		log.Printf("switchbot miniplug sw=%v,over=%v,load=%d", sw, over, load)
+		log.Printf("switchbot miniplug model=%s,sw=%v,over=%v,load=%d", model, sw, over, load)
 	}
-	sendSyslog(fmt.Sprintf("type=SwitchBotPlugMini,address=%s,name=%s,rssi=%d,sw=%v,over=%v,load=%d",
-		d.Address, d.Name, d.RSSI,
-		sw, over, load,
-	))
-	publishMQTT(&mqttPowerMonitorPlugDataEnt{
+	e := &mqttPowerMonitorPlugDataEnt{
 		Time:    time.Now().Format(time.RFC3339),
 		Host:    hostName,
 		Address: d.Address,
 		Name:    d.Name,
 		Type:    "SwitchBotPlugMini",
+		Model:   model,
 		RSSI:    d.RSSI,
 		Switch:  sw,
 		Over:    over,
 		Load:    load,
-	})
+	}
+	if !checkSensorData(d, e.Type, map[string]float64{
+		"load":   float64(e.Load),
+		"switch": getBoolValue(e.Switch),
+		"over":   getBoolValue(e.Over),
+	}) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotPlugMini,address=%s,name=%s,rssi=%d,model=%s,sw=%v,over=%v,load=%d",
+		d.Address, d.Name, d.RSSI, model,
+		sw, over, load,
+	))
+	publishMQTT(e)
 }
 
 func isInkbird(name string) bool {
@@ -497,24 +718,55 @@ func isInkbird(name string) bool {
 		strings.HasPrefix(n, "ink@iam-")
 }
 
+// isInkbirdBBQ : IBBQ-4T/IBT-2X/IBT-4XSなどのBBQ温度計は "iBBQ" という名前で送信する
+func isInkbirdBBQ(name string) bool {
+	n := strings.ToLower(name)
+	return strings.HasPrefix(n, "ibbq") ||
+		strings.HasPrefix(n, "ibt-")
+}
+
+// formatEnvChannels : チャンネル毎の温度をsyslog用の文字列にする
+func formatEnvChannels(chs []envChannelEnt) string {
+	r := ""
+	for _, c := range chs {
+		r += fmt.Sprintf(",%s=%.02f", c.Name, c.Temperature)
+	}
+	return r
+}
+
 func sendInkbirdEnv(d *BluetoothDeviceEnt) {
 	if len(d.EnvData) < 8 {
 		return
 	}
 	var temp, hum, press float64
+	var channels []envChannelEnt
 	bat := -1
 	co2 := 0
+	metrics := []string{"temperature", "humidity"}
 
 	if len(d.EnvData) == 9 {
+		// IBS-TH/IBS-TH2
+		// a9 09  温度 0.01℃
+		// cd 1a  湿度 0.01%
+		// 01     外部プローブ(0=内部センサー,1=外部プローブ)
+		// xx xx  CRC
+		// 5a     バッテリー 1%
 		tempRaw := int16(uint16(d.EnvData[0]) | (uint16(d.EnvData[1]) << 8))
 		humRaw := uint16(d.EnvData[2]) | (uint16(d.EnvData[3]) << 8)
 		bat = int(d.EnvData[7])
+		metrics = append(metrics, "battery")
 		temp = float64(tempRaw) / 100.0
 		hum = float64(humRaw) / 100.0
+		ch := "internal"
+		if d.EnvData[4] == 1 {
+			ch = "external"
+		}
+		channels = append(channels, envChannelEnt{Name: ch, Temperature: temp})
 	} else if len(d.EnvData) == 18 && !strings.HasPrefix(strings.ToLower(d.Name), "ink@iam-") {
 		tempRaw := int16(uint16(d.EnvData[6]) | (uint16(d.EnvData[7]) << 8))
 		humRaw := uint16(d.EnvData[8]) | (uint16(d.EnvData[9]) << 8)
 		bat = int(d.EnvData[10])
+		metrics = append(metrics, "battery")
 		temp = float64(tempRaw) / 100.0
 		hum = float64(humRaw) / 100.0
 	} else if (len(d.EnvData) == 17 || len(d.EnvData) == 18 || len(d.EnvData) == 19) && strings.HasPrefix(strings.ToLower(d.Name), "ink@iam-") {
@@ -522,8 +774,10 @@ func sendInkbirdEnv(d *BluetoothDeviceEnt) {
 		tempRaw := int16((uint16(d.EnvData[10]) << 8) | uint16(d.EnvData[11]))
 		humRaw := (uint16(d.EnvData[12]) << 8) | uint16(d.EnvData[13])
 		co2 = int((uint16(d.EnvData[14]) << 8) | uint16(d.EnvData[15]))
+		metrics = append(metrics, "co2")
 		if len(d.EnvData) >= 18 {
 			press = float64(uint16(d.EnvData[16])<<8 | uint16(d.EnvData[17]))
+			metrics = append(metrics, "pressure")
 		}
 		tempF := float64(tempRaw) / 10.0
 		if (status & 0x02) != 0 {
@@ -536,6 +790,7 @@ func sendInkbirdEnv(d *BluetoothDeviceEnt) {
 		tempRaw := int16((uint16(d.EnvData[2]) << 8) | uint16(d.EnvData[3]))
 		humRaw := (uint16(d.EnvData[4]) << 8) | uint16(d.EnvData[5])
 		co2 = int((uint16(d.EnvData[6]) << 8) | uint16(d.EnvData[7]))
+		metrics = append(metrics, "co2")
 		temp = float64(tempRaw) / 10.0
 		hum = float64(humRaw) / 10.0
 	} else {
@@ -557,9 +812,8 @@ func sendInkbirdEnv(d *BluetoothDeviceEnt) {
 	if press > 0 {
 		msg += fmt.Sprintf(",press=%.02f", press)
 	}
-	sendSyslog(msg)
-
-	publishMQTT(&mqttEnvDataEnt{
+	msg += formatEnvChannels(channels)
+	e := &mqttEnvDataEnt{
 		Time:        time.Now().Format(time.RFC3339),
 		Host:        hostName,
 		Address:     d.Address,
@@ -571,29 +825,92 @@ func sendInkbirdEnv(d *BluetoothDeviceEnt) {
 		Battery:     bat,
 		Co2:         co2,
 		Pressure:    press,
-	})
+		Channels:    channels,
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, metrics...)) {
+		return
+	}
+	sendSyslog(msg)
+
+	publishMQTT(e)
 }
 
-func sendMotionSensor(ms *MotionSensorEnt, event string) {
-	var d *BluetoothDeviceEnt
-	if v, ok := deviceMap.Load(ms.Address); !ok {
+// Inkbird BBQ温度計
+// https://github.com/Bluetooth-Devices/inkbird-ble
+// 00 00  Manufacturer ID(未使用)
+// xx xx  不明
+// xx xx xx xx xx xx  MACアドレス
+// f6 ff  プローブ1 0.1℃ (0xfff6=未接続)
+// d2 00  プローブ2 0.1℃
+// ...    プローブN
+func sendInkbirdBBQ(d *BluetoothDeviceEnt) {
+	if len(d.EnvData) < 12 {
 		return
-	} else {
-		if d, ok = v.(*BluetoothDeviceEnt); !ok {
-			return
+	}
+	var channels []envChannelEnt
+	for i := 10; i+1 < len(d.EnvData); i += 2 {
+		raw := uint16(d.EnvData[i]) | (uint16(d.EnvData[i+1]) << 8)
+		if raw == 0xfff6 || raw == 0xffff {
+			continue
 		}
+		channels = append(channels, envChannelEnt{
+			Name:        fmt.Sprintf("probe%d", (i-10)/2+1),
+			Temperature: float64(int16(raw)) / 10.0,
+		})
+	}
+	if len(channels) < 1 {
+		return
+	}
+	if debug {
+		log.Printf("inkbird type=InkbirdBBQ,probes=%+v", channels)
+	}
+	e := &mqttEnvDataEnt{
+		Time:     time.Now().Format(time.RFC3339),
+		Host:     hostName,
+		Address:  d.Address,
+		Name:     d.Name,
+		Type:     "InkbirdBBQ",
+		RSSI:     d.RSSI,
+		Battery:  -1,
+		Channels: channels,
+	}
+	// 全体の温度はプローブ1が接続されている時だけ(他のプローブはチャンネルで送信する)
+	var metrics []string
+	msg := fmt.Sprintf("type=InkbirdBBQ,address=%s,name=%s,rssi=%d", d.Address, d.Name, d.RSSI)
+	if channels[0].Name == "probe1" {
+		e.Temperature = channels[0].Temperature
+		msg += fmt.Sprintf(",temp=%.02f", e.Temperature)
+		metrics = append(metrics, "temperature")
+	}
+	values := getEnvValues(e, metrics...)
+	for _, c := range channels {
+		values[c.Name] = c.Temperature
+	}
+	if !checkSensorData(d, e.Type, values) {
+		return
+	}
+	sendSyslog(msg + formatEnvChannels(channels))
+	publishMQTT(e)
+}
+
+func sendMotionSensor(ms *MotionSensorEnt, event string) {
+	d := getDeviceEnt(ms.Address)
+	if d == nil {
+		return
 	}
 	if debug {
 		log.Printf("switchbot motion sensor %s %+v %+v", event, d, ms)
 	}
-	sendSyslog(fmt.Sprintf("type=SwitchBotMotionSensor,address=%s,name=%s,rssi=%d,moving=%v,event=%s,lastMoveDiff=%d,lastMove=%s,battery=%d,light=%v",
-		ms.Address, d.Name, d.RSSI, ms.Moving, event, ms.LastMoveDiff, time.Unix(ms.LastMove, 0).Format(time.RFC3339), ms.Battery, ms.Light))
+	model := getSwitchBotModelName(d)
+	sendSyslog(fmt.Sprintf("type=SwitchBotMotionSensor,address=%s,name=%s,rssi=%d,model=%s,moving=%v,event=%s,lastMoveDiff=%d,lastMove=%s,battery=%d,light=%v",
+		ms.Address, d.Name, d.RSSI, model, ms.Moving, event, ms.LastMoveDiff, time.Unix(ms.LastMove, 0).Format(time.RFC3339), ms.Battery, ms.Light))
 	publishMQTT(&mqttMotionSensorDataEnt{
 		Time:         time.Now().Format(time.RFC3339),
 		Host:         hostName,
 		Address:      ms.Address,
 		Name:         d.Name,
 		Type:         "SwitchBotMotionSensor",
+		Model:        model,
 		RSSI:         d.RSSI,
 		Moving:       ms.Moving,
 		Light:        ms.Light,
@@ -604,7 +921,56 @@ func sendMotionSensor(ms *MotionSensorEnt, event string) {
 
 }
 
-var lastSendTime int64
+// lastSendTime : 前回のレポートの日時(起動時は起動した日時)
+var lastSendTime = time.Now().Unix()
+
+// sensorDecoding : 受信時のデコード中
+var sensorDecoding = false
+
+// decodeSensorData : 受信時にセンサーのデータをデコードして、しきい値の判定と変化による送信をする
+// レポートの対象外のデバイスも判定する
+func decodeSensorData(d *BluetoothDeviceEnt) {
+	if len(d.EnvData) < 1 && len(d.SBData) < 1 {
+		return
+	}
+	if len(thresholdRules) < 1 && len(changeTypeMap) < 1 {
+		return
+	}
+	sensorDecoding = true
+	sendSensorData(d)
+	sensorDecoding = false
+}
+
+// sendSensorData : センサーのデータを送信する、戻り値は集計用のセンサーの種類
+func sendSensorData(d *BluetoothDeviceEnt) string {
+	switch {
+	case strings.HasPrefix(d.Name, "Rbt") && isOMRONEnvSensor(d):
+		if sendOMRON(d) {
+			return "omron"
+		}
+	case len(d.EnvData) == 8 && d.EnvData[0] == 0 && d.EnvData[1] == 0x0d && d.EnvData[2] == 0x54:
+		sendSwitchBotEnv(d)
+		return "switchbot"
+	case sendSwitchBot(d):
+		return "switchbot"
+	case isInkbirdBBQ(d.Name) && len(d.EnvData) >= 12:
+		sendInkbirdBBQ(d)
+		return "inkbird"
+	case isInkbird(d.Name) && (len(d.EnvData) == 8 || len(d.EnvData) == 9 || len(d.EnvData) == 17 || len(d.EnvData) == 18 || len(d.EnvData) == 19):
+		sendInkbirdEnv(d)
+		return "inkbird"
+	case d.Code == aranetCode && isAranet4Data(d.EnvData):
+		sendAranet4Env(d)
+		return "aranet"
+	case d.Code == mopekaCode && isMopekaData(d.EnvData):
+		sendMopekaTank(d)
+		return "mopeka"
+	case isQingpingData(d.EnvData):
+		sendQingpingEnv(d)
+		return "qingping"
+	}
+	return ""
+}
 
 func sendReport() {
 	count := 0
@@ -613,57 +979,74 @@ func sendReport() {
 	omron := 0
 	swbot := 0
 	inkbird := 0
+	aranet := 0
+	mopeka := 0
+	qingping := 0
 	report := 0
 	junk := 0
+	stale := 0
+	active := 0
+	removeByClass := make(map[string]int)
 	now := time.Now().Unix()
 	deviceMap.Range(func(k, v interface{}) bool {
 		d, ok := v.(*BluetoothDeviceEnt)
 		if !ok {
 			return true
 		}
-		important := d.Name != "" || d.FixedAddr || len(d.EnvData) > 0
-		if (!important && d.LastTime < now-15*60+10) || d.LastTime < now-60*60*48 {
+		// RSSIの統計はレポート毎にリセットする
+		defer d.RSSIStats.reset()
+		classifyDevice(d)
+		class := getDeviceClass(d)
+		p := retentionPolicyMap[class]
+		if d.LastTime < now-p.Forget {
+			setDeparted(d)
+			forgetSensorChange(d)
+			forgetThresholds(d)
 			deviceMap.Delete(k)
 			remove++
+			removeByClass[class]++
 			return true
 		}
 		count++
-		if !allAddress && !important {
+		updateInventory(d)
+		if d.LastTime >= lastSendTime {
+			active++
+			checkBaseline(d)
+		}
+		if (!allAddress && !p.Report) || !isReportCategory(d.Category) {
 			junk++
 			return true
 		}
-		if d.LastTime < lastSendTime {
+		if (p.StopReport > 0 && d.LastTime < now-p.StopReport) || (p.StopReport == 0 && d.LastTime < lastSendTime) {
+			stale++
 			return true
 		}
 		if d.FirstTime > lastSendTime {
 			newDevices++
 		}
-		if strings.HasPrefix(d.Name, "Rbt") && len(d.EnvData) >= 18 && d.EnvData[0] == 1 {
-			sendOMRONEnv(d)
+		switch sendSensorData(d) {
+		case "omron":
 			omron++
-		} else if len(d.EnvData) == 8 && d.EnvData[0] == 0 && d.EnvData[1] == 0x0d && d.EnvData[2] == 0x54 {
-			sendSwitchBotEnv(d)
+		case "switchbot":
 			swbot++
-		} else if d.Code == 0x0969 && len(d.EnvData) >= 4 {
-			switch d.SBType {
-			case 0x35:
-				sendSwitchBotCo2(d)
-				swbot++
-			case 0x77:
-				sendSwitchBotIP64(d)
-				swbot++
-			default:
-				sendSwitchBotPlugMini(d)
-				swbot++
-			}
-		} else if isInkbird(d.Name) && (len(d.EnvData) == 8 || len(d.EnvData) == 9 || len(d.EnvData) == 17 || len(d.EnvData) == 18 || len(d.EnvData) == 19) {
-			sendInkbirdEnv(d)
+		case "inkbird":
 			inkbird++
+		case "aranet":
+			aranet++
+		case "mopeka":
+			mopeka++
+		case "qingping":
+			qingping++
 		}
 		if debug {
 			log.Println(d.String())
 		}
 		sendSyslog(d.String())
+		var txPower *int
+		if d.HasTxPower {
+			tp := d.TxPower
+			txPower = &tp
+		}
 		publishMQTT(&mqttDeviceDataEnt{
 			Time:        time.Now().Format(time.RFC3339),
 			Host:        hostName,
@@ -673,47 +1056,74 @@ func sendReport() {
 			Info:        d.Info,
 			Vendor:      getVendor(d),
 			UUID:        getUUID(d),
-			MinRSSI:     d.MinRSSI,
-			MaxRSSI:     d.MaxRSSI,
-			RSSI:        d.RSSI,
-			Count:       d.Count,
-			FirstTime:   time.Unix(d.FirstTime, 0).Format(time.RFC3339),
-			LastTime:    time.Unix(d.LastTime, 0).Format(time.RFC3339),
+			UUIDName:    getUUIDNames(d),
+			Appearance:  getAppearanceName(d.Appearance),
+			TxPower:     txPower,
+			Distance:    max(0, estimateDistance(d)),
+			Category:    d.Category,
+			Confidence:  d.Confidence,
+			Identity:    d.Identity,
+			RPA:         d.RPA,
+			Rotations:   d.Rotations,
+			Chain:       d.ChainID,
+			RSSIStats: &mqttRSSIStatsEnt{
+				Samples:  d.RSSIStats.Count,
+				Mean:     d.RSSIStats.mean(),
+				Median:   d.RSSIStats.median(),
+				StdDev:   d.RSSIStats.stddev(),
+				EMA:      d.RSSIStats.EMA,
+				Filtered: getFilteredRSSI(d),
+			},
+			MinRSSI:   d.MinRSSI,
+			MaxRSSI:   d.MaxRSSI,
+			RSSI:      d.RSSI,
+			Count:     d.Count,
+			FirstTime: time.Unix(d.FirstTime, 0).Format(time.RFC3339),
+			LastTime:  time.Unix(d.LastTime, 0).Format(time.RFC3339),
 		})
 		report++
 		return true
 	})
-	motionSensorMap.Range(func(k, v interface{}) bool {
-		if ms, ok := v.(*MotionSensorEnt); ok {
-			sendMotionSensor(ms, "report")
-		}
-		return true
-	})
-	sendSyslog(fmt.Sprintf("type=Stats,total=%d,count=%d,new=%d,remove=%d,report=%d,junk=%d,send=%d,param=%s",
-		total, count, newDevices, remove, report, junk, syslogCount, adapter))
+	sendSwitchBotSensorReport(false)
+	sendMeshReport()
+	sendAnalytics()
+	checkBaselineCount(active)
+	unique := count - getLinkedCount()
+	removeClass := []string{}
+	for _, c := range retentionClassList {
+		removeClass = append(removeClass, fmt.Sprintf("%s:%d", c, removeByClass[c]))
+	}
+	sendSyslog(fmt.Sprintf("type=Stats,total=%d,count=%d,unique=%d,new=%d,remove=%d,removeClass=%s,report=%d,stale=%d,junk=%d,send=%d,param=%s",
+		total, count, unique, newDevices, remove, strings.Join(removeClass, ";"), report, stale, junk, syslogCount, adapter))
 	publishMQTT(&mqttBlueScanStatsDataEnt{
-		Time:    time.Now().Format(time.RFC3339),
-		Host:    hostName,
-		Total:   total,
-		Count:   count,
-		New:     newDevices,
-		Remove:  remove,
-		Report:  report,
-		Adapter: adapter,
-		Junk:    junk,
+		Time:          time.Now().Format(time.RFC3339),
+		Host:          hostName,
+		Total:         total,
+		Count:         count,
+		Unique:        unique,
+		New:           newDevices,
+		Remove:        remove,
+		RemoveByClass: removeByClass,
+		Report:        report,
+		Stale:         stale,
+		Adapter:       adapter,
+		Junk:          junk,
 	})
 	if debug {
-		log.Printf("total=%d skip=%d count=%d new=%d remove=%d omron=%d swbot=%d inkbird=%d send=%d report=%d junk=%d",
-			total, skip, count, newDevices, remove, omron, swbot, inkbird, syslogCount, report, junk)
+		log.Printf("total=%d skip=%d count=%d new=%d remove=%d omron=%d swbot=%d inkbird=%d aranet=%d mopeka=%d qingping=%d send=%d report=%d stale=%d junk=%d",
+			total, skip, count, newDevices, remove, omron, swbot, inkbird, aranet, mopeka, qingping, syslogCount, report, stale, junk)
 	}
+	saveInventory()
 	syslogCount = 0
 	lastSendTime = now
 }
 
+// getUUID : サービスUUIDのリスト(比較できるようにソートする)
 func getUUID(d *BluetoothDeviceEnt) string {
 	var uuids []string
 	for u := range d.UUIDMap {
 		uuids = append(uuids, u)
 	}
+	sort.Strings(uuids)
 	return strings.Join(uuids, ";")
 }
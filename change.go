@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 変化で送信するセンサー
+// 指定した種類のセンサーは受信時にデコードして、値がデッドバンドを超えて変化したら
+// 最小間隔(minInterval秒)以上空けてすぐに送信する
+// 変化がない場合はheartbeat秒毎に送信する(0はレポートの間隔)
+type sensorChangeEnt struct {
+	Last   int64
+	Values map[string]float64
+}
+
+var changeTypeMap = make(map[string]bool)
+
+// changeTypeNames : 変化で送信できるセンサーの種類(イベントのセンサーは定期的な送信をheartbeat毎にする)
+var changeTypeNames = map[string]bool{
+	"OMRONEnv":                true,
+	"OMRONCalc":               true,
+	"SwitchBotEnv":            true,
+	"SwitchBotPlugMini":       true,
+	"InkbirdEnv":              true,
+	"InkbirdBBQ":              true,
+	"Aranet4Env":              true,
+	"QingpingEnv":             true,
+	"MopekaTank":              true,
+	"SwitchBotMotionSensor":   true,
+	"SwitchBotContactSensor":  true,
+	"SwitchBotLeakSensor":     true,
+	"SwitchBotPresenceSensor": true,
+	"SwitchBotActuator":       true,
+}
+
+// deadbandMap : 項目またはセンサーの種類:項目毎のデッドバンド
+var deadbandMap = make(map[string]float64)
+
+var sensorChangeMap = make(map[string]*sensorChangeEnt)
+
+func parseChangeConf(types, deadband string) {
+	if minInterval < 0 || heartbeat < 0 {
+		log.Fatalf("invalid minInterval=%d heartbeat=%d", minInterval, heartbeat)
+	}
+	for _, t := range strings.Split(types, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !changeTypeNames[t] {
+			log.Fatalf("invalid change type=%s", t)
+		}
+		changeTypeMap[t] = true
+	}
+	for _, e := range strings.Split(deadband, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		a := strings.SplitN(e, "=", 2)
+		if len(a) != 2 {
+			log.Fatalf("invalid deadband=%s", e)
+		}
+		m := strings.ToLower(strings.TrimSpace(a[0]))
+		if i := strings.Index(a[0], ":"); i > 0 {
+			m = strings.TrimSpace(a[0][:i]) + ":" + strings.ToLower(strings.TrimSpace(a[0][i+1:]))
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(a[1]), 64)
+		if err != nil || v < 0 {
+			log.Fatalf("invalid deadband=%s", e)
+		}
+		deadbandMap[m] = v
+	}
+}
+
+func getDeadband(typ, metric string) float64 {
+	if v, ok := deadbandMap[typ+":"+metric]; ok {
+		return v
+	}
+	return deadbandMap[metric]
+}
+
+func getHeartbeat() int64 {
+	if heartbeat > 0 {
+		return heartbeat
+	}
+	return int64(syslogInterval)
+}
+
+// checkSensorData : センサーの値をデコードした時に送信するか決める
+// 受信時のデコードではしきい値を判定する
+// 戻り値がfalseの場合は値を送信しない
+func checkSensorData(d *BluetoothDeviceEnt, typ string, values map[string]float64) bool {
+	if sensorDecoding {
+		checkThresholds(d, typ, values)
+	}
+	if !changeTypeMap[typ] {
+		return !sensorDecoding
+	}
+	// 受信時の送信もレポートの対象のデバイスに限る
+	if sensorDecoding && !isSendDevice(d) {
+		return false
+	}
+	now := time.Now().Unix()
+	key := d.Address + "/" + typ
+	s, ok := sensorChangeMap[key]
+	if !ok {
+		s = &sensorChangeEnt{}
+		sensorChangeMap[key] = s
+	}
+	send := s.Last == 0 || now-s.Last >= getHeartbeat()
+	if !send && now-s.Last >= minInterval {
+		for m, v := range values {
+			if p, ok := s.Values[m]; !ok || math.Abs(v-p) > getDeadband(typ, m) {
+				send = true
+				break
+			}
+		}
+	}
+	if !send {
+		return false
+	}
+	if debug && sensorDecoding {
+		log.Printf("sensor change type=%s address=%s values=%v", typ, d.Address, values)
+	}
+	s.Last = now
+	s.Values = values
+	return true
+}
+
+// isHeartbeatDue : イベントで送信するセンサーの定期的な送信をするか決める
+// 変化で送信する種類は10秒毎のチェック(check)でheartbeat毎に、それ以外はレポート毎に送信する
+func isHeartbeatDue(d *BluetoothDeviceEnt, typ string, check bool) bool {
+	if !changeTypeMap[typ] {
+		return !check
+	}
+	if !check {
+		return false
+	}
+	now := time.Now().Unix()
+	key := d.Address + "/" + typ
+	s, ok := sensorChangeMap[key]
+	if !ok {
+		// 最初のイベントは受信時に送信しているため、次の送信はheartbeat後
+		sensorChangeMap[key] = &sensorChangeEnt{Last: now}
+		return false
+	}
+	if now-s.Last < getHeartbeat() {
+		return false
+	}
+	s.Last = now
+	return true
+}
+
+// getBoolValue : オン/オフの項目を変化の判定に使う値にする
+func getBoolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// forgetSensorChange : 削除したデバイスの状態を削除する
+func forgetSensorChange(d *BluetoothDeviceEnt) {
+	if len(sensorChangeMap) < 1 {
+		return
+	}
+	for k := range sensorChangeMap {
+		if strings.HasPrefix(k, d.Address+"/") {
+			delete(sensorChangeMap, k)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// デバイスの分類
+// 会社コード、サービスUUID、Appearance、名前、アドレスの種類、デコードしたベンダーのデータ
+// の条件を組み合わせたルールで分類する
+// 同じ分類に一致したルールの確度は 1-(1-p1)(1-p2)... で合成し、最も確度の高いものを採用する
+const (
+	categoryPhone    = "phone"
+	categoryComputer = "computer"
+	categoryWearable = "wearable"
+	categoryAudio    = "audio"
+	categoryTracker  = "tracker"
+	categoryBeacon   = "beacon"
+	categorySensor   = "sensor"
+	categoryTV       = "tv"
+	categoryVehicle  = "vehicle"
+	categoryUnknown  = "unknown"
+)
+
+// ClassRuleEnt : 分類ルール
+// 指定した条件が全て一致した場合にCategoryに分類する
+// Code,UUIDは16進数、Appearance,AddrTypeは前方一致、Nameは正規表現
+type ClassRuleEnt struct {
+	Category   string `json:"category"`
+	Confidence int    `json:"confidence"`
+	Code       string `json:"code,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	Appearance string `json:"appearance,omitempty"`
+	Name       string `json:"name,omitempty"`
+	AddrType   string `json:"addrType,omitempty"`
+	Frame      string `json:"frame,omitempty"`
+	code       uint16
+	nameReg    *regexp.Regexp
+}
+
+var defaultClassRules = []ClassRuleEnt{
+	// デコードしたベンダーのデータ
+	{Category: categorySensor, Confidence: 95, Frame: "omron"},
+	{Category: categorySensor, Confidence: 95, Frame: "switchbot"},
+	{Category: categorySensor, Confidence: 95, Frame: "inkbird"},
+	{Category: categorySensor, Confidence: 95, Frame: "aranet"},
+	{Category: categorySensor, Confidence: 95, Frame: "mopeka"},
+	{Category: categorySensor, Confidence: 95, Frame: "qingping"},
+	{Category: categorySensor, Confidence: 60, Frame: "mesh"},
+	{Category: categoryBeacon, Confidence: 95, Frame: "ibeacon"},
+	// Appearance
+	{Category: categoryPhone, Confidence: 90, Appearance: "Phone"},
+	{Category: categoryComputer, Confidence: 90, Appearance: "Computer"},
+	{Category: categoryComputer, Confidence: 50, Appearance: "Human Interface Device"},
+	{Category: categoryWearable, Confidence: 90, Appearance: "Watch"},
+	{Category: categoryWearable, Confidence: 80, Appearance: "Eye-glasses"},
+	{Category: categoryWearable, Confidence: 80, Appearance: "Heart Rate Sensor"},
+	{Category: categoryWearable, Confidence: 70, Appearance: "Running Walking Sensor"},
+	{Category: categoryWearable, Confidence: 70, Appearance: "Pulse Oximeter"},
+	{Category: categoryAudio, Confidence: 90, Appearance: "Wearable Audio Device"},
+	{Category: categoryAudio, Confidence: 90, Appearance: "Audio Sink"},
+	{Category: categoryAudio, Confidence: 80, Appearance: "Audio Source"},
+	{Category: categoryAudio, Confidence: 80, Appearance: "Hearing aid"},
+	{Category: categoryTracker, Confidence: 90, Appearance: "Tag"},
+	{Category: categoryTracker, Confidence: 90, Appearance: "Keyring"},
+	{Category: categoryTV, Confidence: 80, Appearance: "Display"},
+	{Category: categoryTV, Confidence: 70, Appearance: "AV Equipment"},
+	{Category: categoryVehicle, Confidence: 90, Appearance: "Motorized Vehicle"},
+	{Category: categorySensor, Confidence: 80, Appearance: "Sensor"},
+	{Category: categorySensor, Confidence: 80, Appearance: "Thermometer"},
+	{Category: categorySensor, Confidence: 70, Appearance: "Weight Scale"},
+	// サービスUUID
+	{Category: categoryTracker, Confidence: 90, UUID: "feec"},
+	{Category: categoryTracker, Confidence: 90, UUID: "feed"},
+	{Category: categoryTracker, Confidence: 70, UUID: "fd5a"},
+	{Category: categoryPhone, Confidence: 80, UUID: "fd6f"},
+	{Category: categoryBeacon, Confidence: 90, UUID: "feaa"},
+	{Category: categoryWearable, Confidence: 70, UUID: "180d"},
+	{Category: categorySensor, Confidence: 70, UUID: "181a"},
+	{Category: categorySensor, Confidence: 70, UUID: "1809"},
+	{Category: categoryAudio, Confidence: 70, UUID: "184e"},
+	// 会社コード
+	{Category: categoryPhone, Confidence: 40, Code: "004c"},
+	{Category: categoryComputer, Confidence: 50, Code: "0006"},
+	{Category: categoryPhone, Confidence: 40, Code: "0075"},
+	{Category: categoryPhone, Confidence: 40, Code: "00e0"},
+	{Category: categoryWearable, Confidence: 60, Code: "0087"},
+	{Category: categoryAudio, Confidence: 60, Code: "009e"},
+	// 名前
+	{Category: categoryPhone, Confidence: 80, Name: `(?i)iphone|pixel|galaxy|xperia|aquos|arrows|redmi`},
+	{Category: categoryComputer, Confidence: 80, Name: `(?i)macbook|imac|mac mini|thinkpad|surface|laptop|^desktop-`},
+	{Category: categoryWearable, Confidence: 70, Name: `(?i)watch|fitbit|forerunner|smart band|mi band|oura`},
+	{Category: categoryAudio, Confidence: 80, Name: `(?i)airpods|buds|headphone|headset|speaker|soundbar|^wh-|^wf-|jbl|bose`},
+	{Category: categoryTracker, Confidence: 80, Name: `(?i)^tile$|airtag|smarttag|mamorio`},
+	{Category: categoryTV, Confidence: 80, Name: `(?i)^\[tv\]|bravia|fire tv|roku|chromecast|\btv\b`},
+	{Category: categoryVehicle, Confidence: 70, Name: `(?i)^(tesla|toyota|honda|nissan|mazda|subaru|ford|bmw)|obd|carplay`},
+	// アドレスの種類
+	{Category: categoryBeacon, Confidence: 20, AddrType: "LE Random(non-resolvable)"},
+}
+
+var classRules []ClassRuleEnt
+var categoryFilterMap = make(map[string]bool)
+
+// loadClassRules : 分類ルールを読み込む、ファイルを指定した場合は既定のルールを置き換える
+func loadClassRules(path string) {
+	rules := defaultClassRules
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("load class rules err=%v", err)
+		}
+		rules = []ClassRuleEnt{}
+		if err := json.Unmarshal(b, &rules); err != nil {
+			log.Fatalf("load class rules err=%v", err)
+		}
+	}
+	classRules = []ClassRuleEnt{}
+	for _, r := range rules {
+		if r.Category == "" || r.Confidence <= 0 || r.Confidence > 100 {
+			log.Fatalf("invalid class rule=%+v", r)
+		}
+		if r.Code != "" {
+			c, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(r.Code), "0x"), 16, 16)
+			if err != nil {
+				log.Fatalf("invalid class rule code=%s", r.Code)
+			}
+			r.code = uint16(c)
+		}
+		if r.Name != "" {
+			reg, err := regexp.Compile(r.Name)
+			if err != nil {
+				log.Fatalf("invalid class rule name=%s err=%v", r.Name, err)
+			}
+			r.nameReg = reg
+		}
+		r.UUID = strings.ToLower(r.UUID)
+		classRules = append(classRules, r)
+	}
+}
+
+// parseCategoryFilter : レポートする分類のリスト(カンマ区切り)
+func parseCategoryFilter(s string) {
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			categoryFilterMap[c] = true
+		}
+	}
+}
+
+func isReportCategory(c string) bool {
+	return len(categoryFilterMap) == 0 || categoryFilterMap[c]
+}
+
+// getFrameType : デコードしたベンダーのデータの種類
+func getFrameType(d *BluetoothDeviceEnt) string {
+	switch {
+	case d.Code == omronCode:
+		return "omron"
+	case d.Code == switchBotCode || d.SBType != 0 ||
+		(len(d.EnvData) == 8 && d.EnvData[0] == 0 && d.EnvData[1] == 0x0d && d.EnvData[2] == 0x54):
+		return "switchbot"
+	case (isInkbird(d.Name) || isInkbirdBBQ(d.Name)) && len(d.EnvData) > 0:
+		return "inkbird"
+	case d.Code == aranetCode && isAranet4Data(d.EnvData):
+		return "aranet"
+	case d.Code == mopekaCode && isMopekaData(d.EnvData):
+		return "mopeka"
+	case isQingpingData(d.EnvData):
+		return "qingping"
+	case d.IBeacon:
+		return "ibeacon"
+	}
+	if _, ok := meshMap.Load(d.Address); ok {
+		return "mesh"
+	}
+	return ""
+}
+
+func (r *ClassRuleEnt) match(d *BluetoothDeviceEnt, frame, appearance string) bool {
+	if r.Code != "" && d.Code != r.code {
+		return false
+	}
+	if r.UUID != "" && !d.UUIDMap[r.UUID] {
+		return false
+	}
+	if r.Appearance != "" && !strings.HasPrefix(appearance, r.Appearance) {
+		return false
+	}
+	if r.nameReg != nil && (d.Name == "" || !r.nameReg.MatchString(d.Name)) {
+		return false
+	}
+	if r.AddrType != "" && !strings.HasPrefix(d.AddressType, r.AddrType) {
+		return false
+	}
+	if r.Frame != "" && frame != r.Frame {
+		return false
+	}
+	return true
+}
+
+// classifyDevice : デバイスを分類して確度(%)と共に保存する
+func classifyDevice(d *BluetoothDeviceEnt) {
+	frame := getFrameType(d)
+	appearance := getAppearanceName(d.Appearance)
+	miss := make(map[string]float64)
+	for i := range classRules {
+		r := &classRules[i]
+		if !r.match(d, frame, appearance) {
+			continue
+		}
+		if _, ok := miss[r.Category]; !ok {
+			miss[r.Category] = 1.0
+		}
+		miss[r.Category] *= 1.0 - float64(r.Confidence)/100.0
+	}
+	d.Category = categoryUnknown
+	d.Confidence = 0
+	cats := []string{}
+	for c := range miss {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+	for _, c := range cats {
+		if p := int((1.0-miss[c])*100.0 + 0.5); p > d.Confidence {
+			d.Category = c
+			d.Confidence = p
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IRKのないランダムアドレスの推定による関連付け
+// 受信しなくなったアドレスと直後に受信を開始したアドレスを
+// Manufacturer Specific Dataの先頭、サービスUUID、TX Power、
+// アドバタイズ間隔、RSSIの連続性から同じデバイスと推定する
+const (
+	correlateIdle     int64 = 15
+	correlateMaxGap   int64 = 30
+	correlateMinScore       = 4
+)
+
+// isRotatingAddress : アドレスが変化する可能性のあるデバイス
+func isRotatingAddress(d *BluetoothDeviceEnt) bool {
+	return !d.FixedAddr && d.Identity == "" && strings.HasPrefix(d.AddressType, "LE Random")
+}
+
+// getCorrelationScore : 同じデバイスである可能性の点数、明らかに異なる場合は-1
+func getCorrelationScore(e, s *BluetoothDeviceEnt) int {
+	if e.AddressType != s.AddressType {
+		return -1
+	}
+	score := 0
+	if len(e.MfgPrefix) > 0 && len(s.MfgPrefix) > 0 {
+		if !bytes.Equal(e.MfgPrefix, s.MfgPrefix) {
+			return -1
+		}
+		score += 3
+	}
+	if len(e.UUIDMap) > 0 && len(s.UUIDMap) > 0 {
+		if getUUID(e) != getUUID(s) {
+			return -1
+		}
+		score += 2
+	}
+	if e.HasTxPower && s.HasTxPower {
+		if e.TxPower != s.TxPower {
+			return -1
+		}
+		score++
+	}
+	if e.Name != "" && s.Name != "" {
+		if e.Name != s.Name {
+			return -1
+		}
+		score++
+	}
+	if e.Interval > 0 && s.Interval > 0 {
+		r := float64(s.Interval) / float64(e.Interval)
+		if r > 0.8 && r < 1.25 {
+			score++
+		} else {
+			score--
+		}
+	}
+	diff := s.FirstRSSI - e.RSSI
+	if diff < 0 {
+		diff *= -1
+	}
+	switch {
+	case diff <= 6:
+		score += 2
+	case diff <= 12:
+		score++
+	default:
+		score--
+	}
+	return score
+}
+
+// correlateAddresses : 受信しなくなったアドレスと新しいアドレスを関連付ける
+func correlateAddresses() {
+	now := time.Now().Unix()
+	ended := []*BluetoothDeviceEnt{}
+	started := []*BluetoothDeviceEnt{}
+	deviceMap.Range(func(k, v interface{}) bool {
+		d, ok := v.(*BluetoothDeviceEnt)
+		if !ok || !isRotatingAddress(d) {
+			return true
+		}
+		if d.Next == "" && d.LastTime < now-correlateIdle && d.LastTime > now-correlateIdle-correlateMaxGap*2 {
+			ended = append(ended, d)
+		}
+		if d.Prev == "" && d.FirstTime > now-correlateIdle-correlateMaxGap*2 {
+			started = append(started, d)
+		}
+		return true
+	})
+	if len(ended) < 1 || len(started) < 1 {
+		return
+	}
+	type pair struct {
+		e, s  *BluetoothDeviceEnt
+		score int
+	}
+	pairs := []pair{}
+	for _, e := range ended {
+		for _, s := range started {
+			if s.FirstTime+2 < e.LastTime || s.FirstTime-e.LastTime > correlateMaxGap {
+				continue
+			}
+			if sc := getCorrelationScore(e, s); sc >= correlateMinScore {
+				pairs = append(pairs, pair{e: e, s: s, score: sc})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].score > pairs[j].score
+	})
+	for _, p := range pairs {
+		if p.e.Next != "" || p.s.Prev != "" {
+			continue
+		}
+		p.e.Next = p.s.Address
+		p.s.Prev = p.e.Address
+		p.s.ChainID = p.e.ChainID
+		mergeVisit(p.e.Address, p.s.Address)
+		if p.s.ChainID == "" {
+			p.s.ChainID = p.e.Address
+		}
+		if debug {
+			log.Printf("correlate %s -> %s score=%d chain=%s", p.e.Address, p.s.Address, p.score, p.s.ChainID)
+		}
+	}
+}
+
+// getLinkedCount : 関連付けた前のアドレスも記録しているデバイスの数
+// 記録しているデバイスの数から引くと物理的なデバイスの推定数になる
+func getLinkedCount() int {
+	n := 0
+	deviceMap.Range(func(k, v interface{}) bool {
+		if d, ok := v.(*BluetoothDeviceEnt); ok && d.Prev != "" {
+			if _, ok := deviceMap.Load(d.Prev); ok {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
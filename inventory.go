@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// デバイスの一覧をファイルに保存して再起動後も初回の受信日時、受信回数を引き継ぐ
+// レポート毎と終了時に保存し、起動時に読み込む
+type InventoryEnt struct {
+	Address     string `json:"address"`
+	AddressType string `json:"address_type"`
+	Name        string `json:"name"`
+	Vendor      string `json:"vendor"`
+	Category    string `json:"category"`
+	Identity    string `json:"identity,omitempty"`
+	Chain       string `json:"chain,omitempty"`
+	Count       int    `json:"count"`
+	FirstTime   int64  `json:"first_time"`
+	LastTime    int64  `json:"last_time"`
+}
+
+type inventoryFileEnt struct {
+	Time          string             `json:"time"`
+	Devices       []*InventoryEnt    `json:"devices"`
+	MotionSensors []*MotionSensorEnt `json:"motion_sensors"`
+}
+
+var inventoryMap = make(map[string]*InventoryEnt)
+
+func loadInventory() {
+	if inventoryFile == "" {
+		return
+	}
+	b, err := os.ReadFile(inventoryFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("load inventory err=%v", err)
+		}
+		return
+	}
+	var f inventoryFileEnt
+	if err := json.Unmarshal(b, &f); err != nil {
+		log.Printf("load inventory err=%v", err)
+		return
+	}
+	limit := getInventoryLimit()
+	for _, e := range f.Devices {
+		if e.LastTime <= limit {
+			continue
+		}
+		if e.Identity != "" {
+			inventoryMap[e.Identity] = e
+		} else {
+			inventoryMap[e.Address] = e
+		}
+	}
+	for _, ms := range f.MotionSensors {
+		if _, ok := inventoryMap[ms.Address]; ok {
+			motionSensorMap.Store(ms.Address, ms)
+		}
+	}
+	log.Printf("load inventory devices=%d", len(inventoryMap))
+}
+
+// restoreInventory : 新しく受信したデバイスに保存した情報を引き継ぐ
+func restoreInventory(d *BluetoothDeviceEnt) {
+	e, ok := inventoryMap[getDeviceID(d)]
+	if !ok {
+		return
+	}
+	d.FirstTime = e.FirstTime
+	d.Count += e.Count
+	if d.Name == "" {
+		d.Name = e.Name
+	}
+	if d.ChainID == "" {
+		d.ChainID = e.Chain
+	}
+}
+
+// updateInventory : レポートの対象となるデバイスを一覧に記録する
+func updateInventory(d *BluetoothDeviceEnt) {
+	if inventoryFile == "" || !isReportDevice(d) {
+		return
+	}
+	inventoryMap[getDeviceID(d)] = &InventoryEnt{
+		Address:     d.Address,
+		AddressType: d.AddressType,
+		Name:        d.Name,
+		Vendor:      getVendor(d),
+		Category:    d.Category,
+		Identity:    d.Identity,
+		Chain:       d.ChainID,
+		Count:       d.Count,
+		FirstTime:   d.FirstTime,
+		LastTime:    d.LastTime,
+	}
+}
+
+func getInventoryLimit() int64 {
+	return time.Now().Unix() - int64(inventoryRetention)*60*60*24
+}
+
+// saveInventory : 保持期間を過ぎたものを削除してファイルに保存する
+func saveInventory() {
+	if inventoryFile == "" {
+		return
+	}
+	limit := getInventoryLimit()
+	f := inventoryFileEnt{
+		Time:          time.Now().Format(time.RFC3339),
+		Devices:       []*InventoryEnt{},
+		MotionSensors: []*MotionSensorEnt{},
+	}
+	for k, e := range inventoryMap {
+		if e.LastTime < limit {
+			delete(inventoryMap, k)
+			continue
+		}
+		f.Devices = append(f.Devices, e)
+	}
+	motionSensorMap.Range(func(k, v interface{}) bool {
+		if ms, ok := v.(*MotionSensorEnt); ok {
+			f.MotionSensors = append(f.MotionSensors, ms)
+		}
+		return true
+	})
+	b, err := json.Marshal(&f)
+	if err != nil {
+		log.Printf("save inventory err=%v", err)
+		return
+	}
+	tmp := inventoryFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("save inventory err=%v", err)
+		return
+	}
+	if err := os.Rename(tmp, inventoryFile); err != nil {
+		log.Printf("save inventory err=%v", err)
+	}
+}
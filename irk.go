@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"strings"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+)
+
+// Identity Resolving Key(IRK)による Resolvable Private Address(RPA)の解決
+// 登録した自社のデバイスはアドレスが変わっても同じID(アイデンティティアドレスまたは別名)で記録する
+// "alice-phone=1abc39e76110ff5ec8715b7907d056ad,aa:bb:cc:dd:ee:ff=..."
+// IRKは最上位バイトを先頭にした16進数
+const rpaCacheSize = 10000
+
+type IRKEnt struct {
+	ID  string
+	Key []byte
+}
+
+var irkList []IRKEnt
+
+// rpaCache : RPAからIDへのキャッシュ(解決できなかったものは空)
+var rpaCache = make(map[string]string)
+
+func parseIRKConf(s string) {
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		a := strings.SplitN(e, "=", 2)
+		if len(a) != 2 || strings.TrimSpace(a[0]) == "" {
+			log.Fatalf("invalid irk=%s", e)
+		}
+		k, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(a[1]), ":", ""))
+		if err != nil || len(k) != 16 {
+			log.Fatalf("invalid irk=%s", e)
+		}
+		irkList = append(irkList, IRKEnt{ID: normalizeID(a[0]), Key: k})
+	}
+}
+
+// normalizeID : 設定したアドレスやIDを比較できる形にする
+func normalizeID(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// getDeviceID : IRKで解決したデバイスはID、それ以外はアドレス
+func getDeviceID(d *BluetoothDeviceEnt) string {
+	if d.Identity != "" {
+		return d.Identity
+	}
+	return d.Address
+}
+
+// resolveAddress : RPAを登録したIRKで解決してIDを返す、解決できない場合は空
+func resolveAddress(addr hci.BtAddress) string {
+	if len(irkList) < 1 || !addr.IsResolvable() {
+		return ""
+	}
+	a := addr.String()
+	if id, ok := rpaCache[a]; ok {
+		return id
+	}
+	if len(rpaCache) >= rpaCacheSize {
+		rpaCache = make(map[string]string)
+	}
+	id := ""
+	for _, irk := range irkList {
+		if addr.Resolve(irk.Key) {
+			id = irk.ID
+			break
+		}
+	}
+	rpaCache[a] = id
+	if debug && id != "" {
+		log.Printf("resolve rpa=%s id=%s", a, id)
+	}
+	return id
+}
@@ -24,10 +24,38 @@ var adapter = ""
 var syslogInterval = 300
 var codeToVendor string
 var addrToVendor string
+var uuidToName string
 var debug bool
 var active bool
 var allAddress bool
 var hostName = ""
+var mopekaTank = ""
+var mopekaLowLevel = 0
+var distanceFactor = 2.0
+var rssiOffset = 0
+var classRuleFile = ""
+var categoryFilter = ""
+var irkConf = ""
+var awayTimeout int64 = 0
+var arriveRSSI = -100
+var rssiHysteresis = 5
+var retentionConf = ""
+var watchList = ""
+var inventoryFile = ""
+var inventoryRetention = 30
+var visitTimeout int64 = 0
+var visitRSSI = -100
+var uniqueWindowList = ""
+var allowList = ""
+var rogueRSSI = -70
+var rogueDuration int64 = 30
+var baselineFile = ""
+var learnPeriod = 168
+var thresholdFile = ""
+var changeTypes = ""
+var deadband = ""
+var minInterval int64 = 10
+var heartbeat int64 = 0
 
 func init() {
 	flag.StringVar(&syslogDst, "syslog", "", "syslog destination list")
@@ -40,10 +68,38 @@ func init() {
 	flag.IntVar(&syslogInterval, "interval", 600, "syslog send interval(sec)")
 	flag.StringVar(&codeToVendor, "code", "", "make company code to vendor map")
 	flag.StringVar(&addrToVendor, "addr", "", "make address to vendor map")
+	flag.StringVar(&uuidToName, "uuid", "", "make uuid to name map")
 	flag.BoolVar(&debug, "debug", false, "debug mode")
 	flag.BoolVar(&active, "active", false, "active scan mode")
 	flag.BoolVar(&allAddress, "all", false, "report all address(include private)")
 	flag.StringVar(&hostName, "host", "", "host name for identification")
+	flag.StringVar(&mopekaTank, "mopekaTank", "20lb/propane", "mopeka tank type/medium list(addr=type/medium)")
+	flag.IntVar(&mopekaLowLevel, "mopekaLowLevel", 0, "mopeka low level alert(%)")
+	flag.Float64Var(&distanceFactor, "distanceFactor", 2.0, "path loss exponent for distance estimation(2.0=free space)")
+	flag.IntVar(&rssiOffset, "rssiOffset", 0, "rssi calibration offset of this host(dB)")
+	flag.StringVar(&classRuleFile, "classRules", "", "device classification rule file(json)")
+	flag.StringVar(&categoryFilter, "category", "", "report device category list(empty=all)")
+	flag.StringVar(&irkConf, "irk", "", "identity resolving key list(id=irk)")
+	flag.Int64Var(&awayTimeout, "awayTimeout", 0, "away timeout for arrival/departure events(sec)(0=disable)")
+	flag.IntVar(&arriveRSSI, "arriveRSSI", -100, "rssi threshold for arrival")
+	flag.IntVar(&rssiHysteresis, "rssiHysteresis", 5, "rssi hysteresis for departure(dB)")
+	flag.StringVar(&retentionConf, "retention", "", "report/retention policy list(class=stop/forget sec)")
+	flag.StringVar(&watchList, "watch", "", "watched device address list")
+	flag.StringVar(&inventoryFile, "inventory", "", "device inventory file path")
+	flag.IntVar(&inventoryRetention, "inventoryRetention", 30, "device inventory retention(days)")
+	flag.Int64Var(&visitTimeout, "visitTimeout", 0, "visit session timeout for dwell-time analytics(sec)(0=disable)")
+	flag.IntVar(&visitRSSI, "visitRSSI", -100, "rssi threshold for visit")
+	flag.StringVar(&uniqueWindowList, "unique", "", "unique device count window list(hour,day,week)")
+	flag.StringVar(&allowList, "allowList", "", "approved device list file for rogue device alert")
+	flag.IntVar(&rogueRSSI, "rogueRSSI", -70, "rssi threshold for rogue device alert")
+	flag.Int64Var(&rogueDuration, "rogueDuration", 30, "duration for rogue device alert(sec)")
+	flag.StringVar(&baselineFile, "baseline", "", "learned baseline file path for anomaly alert")
+	flag.IntVar(&learnPeriod, "learnPeriod", 168, "baseline learning period(hours)")
+	flag.StringVar(&thresholdFile, "thresholds", "", "sensor threshold rules file path for alert")
+	flag.StringVar(&changeTypes, "change", "", "change-driven sensor type list")
+	flag.StringVar(&deadband, "deadband", "", "deadband list for change-driven sensor (metric=value or type:metric=value)")
+	flag.Int64Var(&minInterval, "minInterval", 10, "minimum interval for change-driven sensor(sec)")
+	flag.Int64Var(&heartbeat, "heartbeat", 0, "heartbeat interval for change-driven sensor(sec)")
 	flag.VisitAll(func(f *flag.Flag) {
 		if s := os.Getenv("TWBLUESCAN_" + strings.ToUpper(f.Name)); s != "" {
 			f.Value.Set(s)
@@ -77,6 +133,10 @@ func main() {
 		makeAddressToVendor()
 		return
 	}
+	if uuidToName != "" {
+		makeUUIDToName()
+		return
+	}
 	log.Printf("version=%s", fmt.Sprintf("%s(%s)", version, commit))
 	if adapter == "" {
 		log.Fatalln("no monitor adapter")
@@ -84,6 +144,20 @@ func main() {
 	if syslogDst == "" && mqttDst == "" {
 		log.Fatalln("no syslog or mqtt destination")
 	}
+	parseMopekaTankConf(mopekaTank)
+	if distanceFactor <= 0 {
+		log.Fatalf("invalid distance factor=%f", distanceFactor)
+	}
+	loadClassRules(classRuleFile)
+	parseCategoryFilter(categoryFilter)
+	parseIRKConf(irkConf)
+	parseRetentionConf(retentionConf)
+	parseWatchList(watchList)
+	parseUniqueWindows(uniqueWindowList)
+	loadAllowList(allowList)
+	loadBaseline()
+	loadThresholds(thresholdFile)
+	parseChangeConf(changeTypes, deadband)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Bluetooth Mesh
+// https://www.bluetooth.com/specifications/specs/mesh-protocol/
+const (
+	meshBeaconUnprovisioned = 0x00
+	meshBeaconSecureNetwork = 0x01
+	meshBeaconPrivate       = 0x02
+	meshProvisioningService = 0x1827
+	meshProxyService        = 0x1828
+)
+
+type MeshNodeEnt struct {
+	Address    string
+	State      string
+	Beacon     string
+	DeviceUUID string
+	OOBInfo    uint16
+	NetworkID  string
+	IVIndex    uint32
+	KeyRefresh bool
+	IVUpdate   bool
+	Proxy      string
+	NID        int
+	FirstTime  int64
+	LastTime   int64
+}
+
+var meshMap sync.Map
+
+var meshProxyTypeNames = []string{"network", "node", "private_network", "private_node"}
+
+func getMeshNode(d *BluetoothDeviceEnt) (*MeshNodeEnt, bool) {
+	now := time.Now().Unix()
+	if v, ok := meshMap.Load(d.Address); ok {
+		if n, ok := v.(*MeshNodeEnt); ok {
+			n.LastTime = now
+			return n, false
+		}
+	}
+	n := &MeshNodeEnt{
+		Address:   d.Address,
+		NID:       -1,
+		FirstTime: now,
+		LastTime:  now,
+	}
+	meshMap.Store(d.Address, n)
+	return n, true
+}
+
+// checkMeshBeacon : Mesh Beacon(AD Type 0x2b)
+// Unprovisioned Device beacon
+// 00     Beacon Type
+// xx x 16 Device UUID
+// 00 00  OOB Information
+// (xx xx xx xx URI Hash)
+// Secure Network beacon
+// 01     Beacon Type
+// 00     Flags(bit0=Key Refresh,bit1=IV Update)
+// xx x 8 Network ID
+// 00 00 00 00  IV Index
+// xx x 8 Authentication Value
+func checkMeshBeacon(d *BluetoothDeviceEnt, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	switch data[0] {
+	case meshBeaconUnprovisioned:
+		if len(data) < 19 {
+			return
+		}
+		id, err := uuid.FromBytes(data[1:17])
+		if err != nil {
+			return
+		}
+		updateMeshNode(d, func(n *MeshNodeEnt) {
+			n.State = "unprovisioned"
+			n.Beacon = "unprovisioned"
+			n.DeviceUUID = id.String()
+			n.OOBInfo = binary.BigEndian.Uint16(data[17:19])
+		})
+	case meshBeaconSecureNetwork:
+		if len(data) < 14 {
+			return
+		}
+		updateMeshNode(d, func(n *MeshNodeEnt) {
+			n.State = "provisioned"
+			n.Beacon = "secure_network"
+			n.KeyRefresh = data[1]&0x01 == 0x01
+			n.IVUpdate = data[1]&0x02 == 0x02
+			n.NetworkID = fmt.Sprintf("%x", data[2:10])
+			n.IVIndex = binary.BigEndian.Uint32(data[10:14])
+		})
+	case meshBeaconPrivate:
+		updateMeshNode(d, func(n *MeshNodeEnt) {
+			n.State = "provisioned"
+			n.Beacon = "private"
+		})
+	default:
+		if debug {
+			log.Printf("unknown mesh beacon d=%+v data=%x", d, data)
+		}
+	}
+}
+
+// checkMeshMessage : Mesh Message(AD Type 0x2a)
+// Network PDUは暗号化されているため先頭のIVI/NIDのみ取得する
+func checkMeshMessage(d *BluetoothDeviceEnt, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	updateMeshNode(d, func(n *MeshNodeEnt) {
+		if n.State == "" {
+			n.State = "provisioned"
+		}
+		n.NID = int(data[0] & 0x7f)
+	})
+}
+
+// checkMeshServiceData : Mesh Provisioning/Proxy ServiceのService Data
+// 処理した場合はtrueを返す
+func checkMeshServiceData(d *BluetoothDeviceEnt, data []byte) bool {
+	if len(data) < 3 {
+		return false
+	}
+	switch binary.LittleEndian.Uint16(data) {
+	case meshProvisioningService:
+		// Device UUID(16) + OOB Information(2)
+		if len(data) < 20 {
+			return true
+		}
+		id, err := uuid.FromBytes(data[2:18])
+		if err != nil {
+			return true
+		}
+		updateMeshNode(d, func(n *MeshNodeEnt) {
+			n.State = "unprovisioned"
+			n.DeviceUUID = id.String()
+			n.OOBInfo = binary.BigEndian.Uint16(data[18:20])
+		})
+		return true
+	case meshProxyService:
+		// Identification Type(1) + Network ID(8) または Hash(8) + Random(8)
+		t := int(data[2])
+		updateMeshNode(d, func(n *MeshNodeEnt) {
+			n.State = "provisioned"
+			if t < len(meshProxyTypeNames) {
+				n.Proxy = meshProxyTypeNames[t]
+			} else {
+				n.Proxy = fmt.Sprintf("unknown(%d)", t)
+			}
+			if t == 0 && len(data) >= 11 {
+				n.NetworkID = fmt.Sprintf("%x", data[3:11])
+			}
+		})
+		return true
+	}
+	return false
+}
+
+// updateMeshNode : ノードの情報を更新して、新規または状態が変化した時はイベントを送信する
+func updateMeshNode(d *BluetoothDeviceEnt, f func(n *MeshNodeEnt)) {
+	n, isNew := getMeshNode(d)
+	state := n.State
+	network := n.NetworkID
+	f(n)
+	if isNew {
+		sendMeshNode(d, n, "new")
+	} else if state != n.State || network != n.NetworkID {
+		sendMeshNode(d, n, "change")
+	}
+}
+
+func sendMeshNode(d *BluetoothDeviceEnt, n *MeshNodeEnt, event string) {
+	if debug {
+		log.Printf("mesh node %s %+v", event, n)
+	}
+	sendSyslog(fmt.Sprintf("type=Mesh,address=%s,name=%s,rssi=%d,event=%s,state=%s,beacon=%s,deviceUUID=%s,oob=%04x,networkID=%s,ivIndex=%d,keyRefresh=%v,ivUpdate=%v,proxy=%s,nid=%d,ft=%s,lt=%s",
+		n.Address, d.Name, d.RSSI, event, n.State, n.Beacon, n.DeviceUUID, n.OOBInfo,
+		n.NetworkID, n.IVIndex, n.KeyRefresh, n.IVUpdate, n.Proxy, n.NID,
+		time.Unix(n.FirstTime, 0).Format(time.RFC3339),
+		time.Unix(n.LastTime, 0).Format(time.RFC3339),
+	))
+	publishMQTT(&mqttMeshDataEnt{
+		Time:       time.Now().Format(time.RFC3339),
+		Host:       hostName,
+		Address:    n.Address,
+		Name:       d.Name,
+		RSSI:       d.RSSI,
+		Event:      event,
+		State:      n.State,
+		Beacon:     n.Beacon,
+		DeviceUUID: n.DeviceUUID,
+		OOBInfo:    n.OOBInfo,
+		NetworkID:  n.NetworkID,
+		IVIndex:    n.IVIndex,
+		KeyRefresh: n.KeyRefresh,
+		IVUpdate:   n.IVUpdate,
+		Proxy:      n.Proxy,
+		NID:        n.NID,
+		FirstTime:  time.Unix(n.FirstTime, 0).Format(time.RFC3339),
+		LastTime:   time.Unix(n.LastTime, 0).Format(time.RFC3339),
+	})
+}
+
+// sendMeshReport : 前回のレポート以降に受信したメッシュノードを送信する
+func sendMeshReport() {
+	now := time.Now().Unix()
+	meshMap.Range(func(k, v interface{}) bool {
+		n, ok := v.(*MeshNodeEnt)
+		if !ok {
+			return true
+		}
+		d := getDeviceEnt(n.Address)
+		if d == nil || n.LastTime < now-60*60*48 {
+			meshMap.Delete(k)
+			return true
+		}
+		if n.LastTime < lastSendTime {
+			return true
+		}
+		sendMeshNode(d, n, "report")
+		return true
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mopeka Pro/Pro Check タンク残量センサー
+// https://github.com/Bluetooth-Devices/mopeka-iot-ble
+// Manufacturer Specific Data(0x0059)
+// 03     ハードウェアID(モデル)
+// 60     バッテリー bit0-6 1/32V
+// 3c     bit7=同期ボタン bit0-6=温度(-40℃)
+// 10 45  bit0-13=液面の反射時間(us) bit14-15=品質(0-3)
+// xx xx xx MACアドレス下位3バイト
+// 00     加速度X
+// 00     加速度Y
+const mopekaCode = 0x0059
+
+// mopekaModelMap : ハードウェアID毎のモデル(mopeka-iot-bleのDEVICE_TYPESと同じ)
+var mopekaModelMap = map[byte]string{
+	0x03: "ProCheck",
+	0x04: "Pro200",
+	0x05: "ProCheckH2O",
+	0x06: "BottleCheck",
+	0x08: "ProPlus",
+	0x09: "ProPlusCellular",
+	0x0a: "TD40/TD200",
+	0x0b: "TD40/TD200Cellular",
+	0x0c: "ProCheckUniversal",
+}
+
+// mopekaMediumMap : 媒体毎の反射時間から液面の高さ(mm)への変換係数(温度の2次式)
+var mopekaMediumMap = map[string][3]float64{
+	"propane": {0.573045, -0.002822, -0.00000535},
+	"air":     {0.153096, 0.000327, -0.000000294},
+	"water":   {0.600592, 0.003124, -0.00001368},
+}
+
+// mopekaTankMap : タンクの種類毎の有効な高さ(mm)
+var mopekaTankMap = map[string]float64{
+	"20lb":   254,
+	"30lb":   381,
+	"40lb":   508,
+	"100lb":  915,
+	"120gal": 610,
+	"250gal": 760,
+	"500gal": 940,
+}
+
+type mopekaTankConfEnt struct {
+	Tank   string
+	Height float64
+	Medium string
+}
+
+var mopekaDefaultConf = mopekaTankConfEnt{Tank: "20lb", Height: 254, Medium: "propane"}
+var mopekaConfMap = make(map[string]mopekaTankConfEnt)
+
+type MopekaEnt struct {
+	Address string
+	Low     bool
+}
+
+var mopekaMap sync.Map
+
+func isMopekaData(data []byte) bool {
+	if len(data) != 10 {
+		return false
+	}
+	_, ok := mopekaModelMap[data[0]]
+	return ok
+}
+
+// parseMopekaTankConf : タンクの設定を読み込む
+// "20lb/propane,aa:bb:cc:dd:ee:ff=40lb/water,11:22:33:44:55:66=300/propane"
+// アドレスのないものは既定値、タンクの種類は高さ(mm)でも指定できる
+func parseMopekaTankConf(s string) {
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		addr := ""
+		if i := strings.Index(e, "="); i > 0 {
+			addr = strings.ToLower(strings.TrimSpace(e[:i]))
+			e = e[i+1:]
+		}
+		c := mopekaDefaultConf
+		a := strings.SplitN(e, "/", 2)
+		if h, ok := mopekaTankMap[a[0]]; ok {
+			c.Tank = a[0]
+			c.Height = h
+		} else if h, err := strconv.ParseFloat(a[0], 64); err == nil && h > 0 {
+			c.Tank = a[0] + "mm"
+			c.Height = h
+		} else {
+			log.Fatalf("invalid mopeka tank=%s", a[0])
+		}
+		if len(a) > 1 {
+			if _, ok := mopekaMediumMap[a[1]]; !ok {
+				log.Fatalf("invalid mopeka medium=%s", a[1])
+			}
+			c.Medium = a[1]
+		}
+		if addr == "" {
+			mopekaDefaultConf = c
+		} else {
+			mopekaConfMap[addr] = c
+		}
+	}
+}
+
+func getMopekaTankConf(addr string) mopekaTankConfEnt {
+	if c, ok := mopekaConfMap[strings.ToLower(addr)]; ok {
+		return c
+	}
+	return mopekaDefaultConf
+}
+
+type mopekaReading struct {
+	Model   string
+	Raw     int
+	Level   float64
+	Percent float64
+	Quality int
+	Temp    float64
+	Battery int
+	AccX    int
+	AccY    int
+	Conf    mopekaTankConfEnt
+}
+
+func getMopekaReading(d *BluetoothDeviceEnt) *mopekaReading {
+	if !isMopekaData(d.EnvData) {
+		return nil
+	}
+	r := &mopekaReading{
+		Model:   mopekaModelMap[d.EnvData[0]],
+		Raw:     (int(d.EnvData[4])*256 + int(d.EnvData[3])) & 0x3fff,
+		Quality: int(d.EnvData[4] >> 6),
+		Temp:    float64(int(d.EnvData[2]&0x7f) - 40),
+		AccX:    int(int8(d.EnvData[8])),
+		AccY:    int(int8(d.EnvData[9])),
+		Conf:    getMopekaTankConf(d.Address),
+	}
+	v := float64(d.EnvData[1]&0x7f) / 32.0
+	r.Battery = max(0, min(100, int((v-2.2)/0.65*100)))
+	k := mopekaMediumMap[r.Conf.Medium]
+	r.Level = float64(r.Raw) * (k[0] + k[1]*r.Temp + k[2]*r.Temp*r.Temp)
+	r.Percent = max(0, min(100, r.Level*100/r.Conf.Height))
+	return r
+}
+
+// checkMopekaLevel : 残量低下を監視して即時に通知する
+func checkMopekaLevel(d *BluetoothDeviceEnt) {
+	if mopekaLowLevel <= 0 {
+		return
+	}
+	r := getMopekaReading(d)
+	if r == nil || r.Quality < 1 {
+		return
+	}
+	var m *MopekaEnt
+	if v, ok := mopekaMap.Load(d.Address); ok {
+		m, _ = v.(*MopekaEnt)
+	}
+	if m == nil {
+		m = &MopekaEnt{Address: d.Address}
+		mopekaMap.Store(d.Address, m)
+	}
+	if !m.Low && r.Percent < float64(mopekaLowLevel) {
+		m.Low = true
+		sendMopeka(d, r, "low")
+	} else if m.Low && r.Percent >= float64(mopekaLowLevel+5) {
+		m.Low = false
+		sendMopeka(d, r, "normal")
+	}
+}
+
+func sendMopekaTank(d *BluetoothDeviceEnt) {
+	r := getMopekaReading(d)
+	if r == nil {
+		return
+	}
+	if !checkSensorData(d, "MopekaTank", map[string]float64{
+		"temperature": r.Temp,
+		"battery":     float64(r.Battery),
+		"level":       r.Level,
+		"percent":     r.Percent,
+		"quality":     float64(r.Quality),
+	}) {
+		return
+	}
+	sendMopeka(d, r, "report")
+}
+
+func sendMopeka(d *BluetoothDeviceEnt, r *mopekaReading, event string) {
+	if debug {
+		log.Printf("mopeka %s %+v", event, r)
+	}
+	sendSyslog(fmt.Sprintf("type=MopekaTank,address=%s,name=%s,rssi=%d,model=%s,event=%s,level=%.01f,percent=%.01f,quality=%d,temp=%.01f,bat=%d,accX=%d,accY=%d,tank=%s,medium=%s",
+		d.Address, d.Name, d.RSSI, r.Model, event, r.Level, r.Percent, r.Quality,
+		r.Temp, r.Battery, r.AccX, r.AccY, r.Conf.Tank, r.Conf.Medium))
+	publishMQTT(&mqttTankDataEnt{
+		Time:        time.Now().Format(time.RFC3339),
+		Host:        hostName,
+		Address:     d.Address,
+		Name:        d.Name,
+		Type:        "MopekaTank",
+		Model:       r.Model,
+		RSSI:        d.RSSI,
+		Event:       event,
+		Level:       r.Level,
+		Percent:     r.Percent,
+		Quality:     r.Quality,
+		Temperature: r.Temp,
+		Battery:     r.Battery,
+		AccX:        r.AccX,
+		AccY:        r.AccY,
+		Tank:        r.Conf.Tank,
+		Medium:      r.Conf.Medium,
+	})
+}
@@ -12,43 +12,80 @@ import (
 var mqttCh = make(chan interface{}, 2000)
 
 type mqttDeviceDataEnt struct {
-	Time        string `json:"time"`
-	Host        string `json:"host"`
-	Address     string `json:"address"`
-	AddressType string `json:"address_type"`
-	Name        string `json:"name"`
-	Vendor      string `json:"vendor"`
-	MinRSSI     int    `json:"min_rssi"`
-	MaxRSSI     int    `json:"max_rssi"`
-	RSSI        int    `json:"rssi"`
-	Info        string `json:"info"`
-	UUID        string `json:"uuid"`
-	Count       int    `json:"count"`
-	FirstTime   string `json:"first_time"`
-	LastTime    string `json:"last_time"`
+	Time        string            `json:"time"`
+	Host        string            `json:"host"`
+	Address     string            `json:"address"`
+	AddressType string            `json:"address_type"`
+	Name        string            `json:"name"`
+	Vendor      string            `json:"vendor"`
+	MinRSSI     int               `json:"min_rssi"`
+	MaxRSSI     int               `json:"max_rssi"`
+	RSSI        int               `json:"rssi"`
+	Info        string            `json:"info"`
+	UUID        string            `json:"uuid"`
+	UUIDName    string            `json:"uuid_name"`
+	Appearance  string            `json:"appearance,omitempty"`
+	TxPower     *int              `json:"tx_power,omitempty"`
+	Distance    float64           `json:"estimated_distance,omitempty"`
+	Category    string            `json:"category"`
+	Confidence  int               `json:"confidence"`
+	Identity    string            `json:"identity,omitempty"`
+	RPA         string            `json:"rpa,omitempty"`
+	Rotations   int               `json:"rotations,omitempty"`
+	Chain       string            `json:"chain,omitempty"`
+	RSSIStats   *mqttRSSIStatsEnt `json:"rssi_stats,omitempty"`
+	Count       int               `json:"count"`
+	FirstTime   string            `json:"first_time"`
+	LastTime    string            `json:"last_time"`
+}
+
+type mqttRSSIStatsEnt struct {
+	Samples  int     `json:"samples"`
+	Mean     float64 `json:"mean"`
+	Median   int     `json:"median"`
+	StdDev   float64 `json:"stddev"`
+	EMA      float64 `json:"ema"`
+	Filtered float64 `json:"filtered"`
 }
 
 type mqttEnvDataEnt struct {
-	Time        string  `json:"time"`
-	Host        string  `json:"host"`
-	Type        string  `json:"type"`
-	Address     string  `json:"address"`
+	Time        string          `json:"time"`
+	Host        string          `json:"host"`
+	Type        string          `json:"type"`
+	Model       string          `json:"model,omitempty"`
+	Address     string          `json:"address"`
+	Name        string          `json:"name"`
+	RSSI        int             `json:"rssi"`
+	Temperature float64         `json:"temperature"`
+	Humidity    float64         `json:"humidity"`
+	Co2         int             `json:"co2"`
+	Lux         int             `json:"lux"`
+	Battery     int             `json:"battery"`
+	Pressure    float64         `json:"pressure"`
+	TVOC        int             `json:"tvoc"`
+	Sound       float64         `json:"sound"`
+	PM1         int             `json:"pm1,omitempty"` // Qingpingのアドバタイズには含まれない
+	PM25        int             `json:"pm25,omitempty"`
+	PM10        int             `json:"pm10,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Interval    int             `json:"interval,omitempty"`
+	Age         int             `json:"age,omitempty"`
+	Channels    []envChannelEnt `json:"channels,omitempty"`
+	Discomfort  float64         `json:"discomfort,omitempty"`
+	HeatStroke  float64         `json:"heat_stroke,omitempty"`
+}
+
+// envChannelEnt : 複数のプローブを持つセンサーのチャンネル毎の値
+type envChannelEnt struct {
 	Name        string  `json:"name"`
-	RSSI        int     `json:"rssi"`
 	Temperature float64 `json:"temperature"`
-	Humidity    float64 `json:"humidity"`
-	Co2         int     `json:"co2"`
-	Lux         int     `json:"lux"`
-	Battery     int     `json:"battery"`
-	Pressure    float64 `json:"pressure"`
-	TVOC        int     `json:"tvoc"`
-	Sound       float64 `json:"sound"`
 }
 
 type mqttMotionSensorDataEnt struct {
 	Time         string `json:"time"`
 	Host         string `json:"host"`
 	Type         string `json:"type"`
+	Model        string `json:"model,omitempty"`
 	Address      string `json:"address"`
 	Name         string `json:"name"`
 	RSSI         int    `json:"rssi"`
@@ -59,10 +96,154 @@ type mqttMotionSensorDataEnt struct {
 	Light        bool   `json:"light"`
 }
 
+type mqttContactSensorDataEnt struct {
+	Time           string `json:"time"`
+	Host           string `json:"host"`
+	Type           string `json:"type"`
+	Address        string `json:"address"`
+	Name           string `json:"name"`
+	RSSI           int    `json:"rssi"`
+	Event          string `json:"event"`
+	Open           bool   `json:"open"`
+	Timeout        bool   `json:"timeout"`
+	LastChangeDiff int64  `json:"last_change_diff"`
+	Button         int    `json:"button"`
+	Entrance       int    `json:"entrance"`
+	Exit           int    `json:"exit"`
+	Direction      string `json:"direction"`
+	Moving         bool   `json:"moving"`
+	Light          bool   `json:"light"`
+	Battery        int    `json:"battery"`
+}
+
+type mqttLeakSensorDataEnt struct {
+	Time     string `json:"time"`
+	Host     string `json:"host"`
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	Name     string `json:"name"`
+	RSSI     int    `json:"rssi"`
+	Event    string `json:"event"`
+	Leak     bool   `json:"leak"`
+	Tampered bool   `json:"tampered"`
+	Battery  int    `json:"battery"`
+}
+
+type mqttPresenceSensorDataEnt struct {
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	Type       string `json:"type"`
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	RSSI       int    `json:"rssi"`
+	Event      string `json:"event"`
+	Presence   bool   `json:"presence"`
+	LastChange int64  `json:"last_change"`
+	Light      int    `json:"light"`
+	Battery    int    `json:"battery"`
+}
+
+type mqttActuatorDataEnt struct {
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	Type       string `json:"type"`
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	RSSI       int    `json:"rssi"`
+	Event      string `json:"event"`
+	Model      string `json:"model"`
+	State      string `json:"state"`
+	Mode       string `json:"mode"`
+	Position   int    `json:"position"`
+	Moving     bool   `json:"moving"`
+	Calibrated bool   `json:"calibrated"`
+	DoorOpen   bool   `json:"door_open"`
+	Battery    int    `json:"battery"`
+}
+
+type mqttVibrationDataEnt struct {
+	Time      string  `json:"time"`
+	Host      string  `json:"host"`
+	Type      string  `json:"type"`
+	Address   string  `json:"address"`
+	Name      string  `json:"name"`
+	RSSI      int     `json:"rssi"`
+	Event     string  `json:"event"`
+	Vibration string  `json:"vibration"`
+	SI        float64 `json:"si"`
+	PGA       float64 `json:"pga"`
+	Intensity float64 `json:"intensity"`
+}
+
+// mqttOMRONFlagDataEnt : OMRON環境センサーのフラグ(項目毎にセットされているイベント)
+type mqttOMRONFlagDataEnt struct {
+	Time        string   `json:"time"`
+	Host        string   `json:"host"`
+	Type        string   `json:"type"`
+	Address     string   `json:"address"`
+	Name        string   `json:"name"`
+	RSSI        int      `json:"rssi"`
+	Seq         int      `json:"seq"`
+	Temperature []string `json:"temperature,omitempty"`
+	Humidity    []string `json:"humidity,omitempty"`
+	Light       []string `json:"light,omitempty"`
+	Pressure    []string `json:"pressure,omitempty"`
+	Noise       []string `json:"noise,omitempty"`
+	ETVOC       []string `json:"etvoc,omitempty"`
+	ECO2        []string `json:"eco2,omitempty"`
+	Discomfort  []string `json:"discomfort,omitempty"`
+	HeatStroke  []string `json:"heat_stroke,omitempty"`
+	SI          []string `json:"si,omitempty"`
+	PGA         []string `json:"pga,omitempty"`
+	Intensity   []string `json:"intensity,omitempty"`
+}
+
+type mqttMeshDataEnt struct {
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	RSSI       int    `json:"rssi"`
+	Event      string `json:"event"`
+	State      string `json:"state"`
+	Beacon     string `json:"beacon"`
+	DeviceUUID string `json:"device_uuid"`
+	OOBInfo    uint16 `json:"oob_info"`
+	NetworkID  string `json:"network_id"`
+	IVIndex    uint32 `json:"iv_index"`
+	KeyRefresh bool   `json:"key_refresh"`
+	IVUpdate   bool   `json:"iv_update"`
+	Proxy      string `json:"proxy"`
+	NID        int    `json:"nid"`
+	FirstTime  string `json:"first_time"`
+	LastTime   string `json:"last_time"`
+}
+
+type mqttTankDataEnt struct {
+	Time        string  `json:"time"`
+	Host        string  `json:"host"`
+	Type        string  `json:"type"`
+	Model       string  `json:"model"`
+	Address     string  `json:"address"`
+	Name        string  `json:"name"`
+	RSSI        int     `json:"rssi"`
+	Event       string  `json:"event"`
+	Level       float64 `json:"level"`
+	Percent     float64 `json:"percent"`
+	Quality     int     `json:"quality"`
+	Temperature float64 `json:"temperature"`
+	Battery     int     `json:"battery"`
+	AccX        int     `json:"acc_x"`
+	AccY        int     `json:"acc_y"`
+	Tank        string  `json:"tank"`
+	Medium      string  `json:"medium"`
+}
+
 type mqttPowerMonitorPlugDataEnt struct {
 	Time    string `json:"time"`
 	Host    string `json:"host"`
 	Type    string `json:"type"`
+	Model   string `json:"model,omitempty"`
 	Address string `json:"address"`
 	Name    string `json:"name"`
 	RSSI    int    `json:"rssi"`
@@ -71,16 +252,92 @@ type mqttPowerMonitorPlugDataEnt struct {
 	Load    int    `json:"load"`
 }
 
+type mqttDevicePresenceDataEnt struct {
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	Address    string `json:"address"`
+	Name       string `json:"name"`
+	RSSI       int    `json:"rssi"`
+	Vendor     string `json:"vendor"`
+	Category   string `json:"category"`
+	Event      string `json:"event"`
+	Dwell      int64  `json:"dwell"`
+	ArriveTime string `json:"arrive_time"`
+	LastTime   string `json:"last_time"`
+}
+
+type mqttVisitDataEnt struct {
+	Time     string `json:"time"`
+	Host     string `json:"host"`
+	Address  string `json:"address"`
+	Enter    string `json:"enter"`
+	Exit     string `json:"exit"`
+	Dwell    int64  `json:"dwell"`
+	PeakRSSI int    `json:"peak_rssi"`
+}
+
+type dwellHistEnt struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type mqttAnalyticsDataEnt struct {
+	Time      string         `json:"time"`
+	Host      string         `json:"host"`
+	Active    int            `json:"active"`
+	NewVisits int            `json:"new_visits"`
+	Visits    int            `json:"visits"`
+	DwellAvg  float64        `json:"dwell_avg"`
+	DwellP50  int64          `json:"dwell_p50"`
+	DwellP90  int64          `json:"dwell_p90"`
+	DwellP95  int64          `json:"dwell_p95"`
+	Histogram []dwellHistEnt `json:"histogram"`
+}
+
+type mqttUniqueCountDataEnt struct {
+	Time     string         `json:"time"`
+	Host     string         `json:"host"`
+	Window   string         `json:"window"`
+	Start    string         `json:"start"`
+	End      string         `json:"end"`
+	Total    int            `json:"total"`
+	AddrType map[string]int `json:"address_type"`
+	Category map[string]int `json:"category"`
+}
+
+type mqttAlertDataEnt struct {
+	Time     string   `json:"time"`
+	Host     string   `json:"host"`
+	Type     string   `json:"type"`
+	Event    string   `json:"event"`
+	Severity string   `json:"severity"`
+	Address  string   `json:"address"`
+	Name     string   `json:"name"`
+	RSSI     int      `json:"rssi"`
+	Vendor   string   `json:"vendor,omitempty"`
+	Category string   `json:"category,omitempty"`
+	Duration int64    `json:"duration,omitempty"`
+	Score    int      `json:"score,omitempty"`
+	Sensor   string   `json:"sensor,omitempty"`
+	Metric   string   `json:"metric,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+	Limit    *float64 `json:"limit,omitempty"`
+	Expected float64  `json:"expected,omitempty"`
+}
+
 type mqttBlueScanStatsDataEnt struct {
-	Time    string `json:"time"`
-	Host    string `json:"host"`
-	Total   int    `json:"total"`
-	Count   int    `json:"count"`
-	New     int    `json:"new"`
-	Remove  int    `json:"remove"`
-	Report  int    `json:"report"`
-	Junk    int    `json:"junk"`
-	Adapter string `json:"adapter"`
+	Time          string         `json:"time"`
+	Host          string         `json:"host"`
+	Total         int            `json:"total"`
+	Count         int            `json:"count"`
+	Unique        int            `json:"unique"`
+	New           int            `json:"new"`
+	Remove        int            `json:"remove"`
+	RemoveByClass map[string]int `json:"remove_by_class"`
+	Report        int            `json:"report"`
+	Stale         int            `json:"stale"`
+	Junk          int            `json:"junk"`
+	Adapter       string         `json:"adapter"`
 }
 
 type mqttMonitorDataEnt struct {
@@ -151,8 +408,38 @@ func getMqttTopic(msg interface{}) string {
 		r += "/Env/" + m.Address
 	case *mqttMotionSensorDataEnt:
 		r += "/Motion/" + m.Address
+	case *mqttContactSensorDataEnt:
+		r += "/Contact/" + m.Address
+	case *mqttLeakSensorDataEnt:
+		r += "/Leak/" + m.Address
+	case *mqttPresenceSensorDataEnt:
+		r += "/Presence/" + m.Address
+	case *mqttActuatorDataEnt:
+		r += "/Actuator/" + m.Address
+	case *mqttVibrationDataEnt:
+		r += "/Vibration/" + m.Address
+	case *mqttOMRONFlagDataEnt:
+		r += "/Flag/" + m.Address
+	case *mqttMeshDataEnt:
+		r += "/Mesh/" + m.Address
+	case *mqttTankDataEnt:
+		r += "/Tank/" + m.Address
+	case *mqttDevicePresenceDataEnt:
+		r += "/DevicePresence/" + m.Address
 	case *mqttPowerMonitorPlugDataEnt:
 		r += "/Power/" + m.Address
+	case *mqttVisitDataEnt:
+		r += "/Visit/" + m.Address
+	case *mqttAnalyticsDataEnt:
+		r += "/Analytics/" + hostName
+	case *mqttUniqueCountDataEnt:
+		r += "/UniqueCount/" + hostName
+	case *mqttAlertDataEnt:
+		if m.Address != "" {
+			r += "/Alert/" + m.Address
+		} else {
+			r += "/Alert/" + hostName
+		}
 	case *mqttBlueScanStatsDataEnt:
 		r += "/BlueScanStats/" + hostName
 	case *mqttMonitorDataEnt:
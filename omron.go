@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OMRON環境センサー(2JCIE-BU01/BL01)のアドバタイズモード毎のData Type
+const (
+	omronCode          = 0x02d5
+	omronDataSensor    = 0x01
+	omronDataCalc      = 0x02
+	omronDataFlag      = 0x03
+	omronVibrationNone = 0
+)
+
+type OMRONEnt struct {
+	Address   string
+	EnvSeq    int
+	ReportSeq int
+	CalcSeq   int
+	FlagSeq   int
+	FlagSent  int
+	Vibration int
+	Calc      []byte
+	Flag      []byte
+}
+
+var omronMap sync.Map
+
+var omronVibrationNames = []string{"none", "vibration", "earthquake"}
+
+func getOMRONVibrationName(v int) string {
+	if v >= 0 && v < len(omronVibrationNames) {
+		return omronVibrationNames[v]
+	}
+	return fmt.Sprintf("unknown(%d)", v)
+}
+
+func getOMRONEnt(addr string) *OMRONEnt {
+	if v, ok := omronMap.Load(addr); ok {
+		if o, ok := v.(*OMRONEnt); ok {
+			return o
+		}
+	}
+	o := &OMRONEnt{
+		Address:   addr,
+		EnvSeq:    -1,
+		ReportSeq: -1,
+		CalcSeq:   -1,
+		FlagSeq:   -1,
+		FlagSent:  -1,
+	}
+	omronMap.Store(addr, o)
+	return o
+}
+
+func isOMRONEnvSensor(d *BluetoothDeviceEnt) bool {
+	if d.Code != omronCode {
+		return false
+	}
+	if len(d.EnvData) >= 18 && d.EnvData[0] == omronDataSensor {
+		return true
+	}
+	_, ok := omronMap.Load(d.Address)
+	return ok
+}
+
+// checkOMRONData : Data Type 0x01以外のデータを処理する
+// 計算データ(Data Type 0x02)
+// https://omronfs.omron.com/ja_JP/ecb/products/pdf/CDSC-016A-web1.pdf
+// 02     Data Type
+// c5     連番
+// 6c 1a  不快指数 0.01
+// 5e 0b  熱中症警戒度 0.01℃
+// 00     振動情報(0=なし,1=振動中,2=地震中)
+// 00 00  SI値 0.1kine
+// 00 00  PGA 0.1gal
+// 00 00  震度相当値 0.001
+// フラグ(Data Type 0x03)
+// 03     Data Type
+// c5     連番
+// 00 00 x 7  センサーフラグ(温度,湿度,照度,気圧,騒音,eTVOC,eCO2)
+// 00 00 x 2  計算フラグ(不快指数,熱中症警戒度)
+// 00 00 00   計算フラグ(SI値,PGA,震度相当値)
+// 各フラグはリトルエンディアンのイベントのビット(omronFlagBitNames)
+func checkOMRONData(d *BluetoothDeviceEnt, data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	switch data[0] {
+	case omronDataCalc:
+		if len(data) < 13 {
+			return
+		}
+		o := getOMRONEnt(d.Address)
+		seq := int(data[1])
+		if seq == o.CalcSeq {
+			// 同じ計測値の再送
+			return
+		}
+		o.CalcSeq = seq
+		o.Calc = data
+		v := int(data[6])
+		if v != o.Vibration {
+			o.Vibration = v
+			if v == omronVibrationNone {
+				sendOMRONVibration(d, o, "stop")
+			} else {
+				sendOMRONVibration(d, o, getOMRONVibrationName(v))
+			}
+		}
+	case omronDataFlag:
+		if len(data) < 23 {
+			return
+		}
+		o := getOMRONEnt(d.Address)
+		seq := int(data[1])
+		if seq == o.FlagSeq {
+			return
+		}
+		o.FlagSeq = seq
+		o.Flag = data
+	default:
+		if debug {
+			log.Printf("unknown omron data type=%02x data=%x", data[0], data)
+		}
+	}
+}
+
+func getOMRONSeismic(calc []byte) (si, pga, intensity float64) {
+	si = float64(int(calc[8])*256+int(calc[7])) * 0.1
+	pga = float64(int(calc[10])*256+int(calc[9])) * 0.1
+	intensity = float64(int(calc[12])*256+int(calc[11])) * 0.001
+	return
+}
+
+func sendOMRONVibration(d *BluetoothDeviceEnt, o *OMRONEnt, event string) {
+	if len(o.Calc) < 13 {
+		return
+	}
+	si, pga, intensity := getOMRONSeismic(o.Calc)
+	vibration := getOMRONVibrationName(o.Vibration)
+	if debug {
+		log.Printf("omron vibration %s %+v %+v", event, d, o)
+	}
+	sendSyslog(fmt.Sprintf("type=OMRONVibration,address=%s,name=%s,rssi=%d,event=%s,vibration=%s,si=%.01f,pga=%.01f,intensity=%.03f",
+		d.Address, d.Name, d.RSSI, event, vibration, si, pga, intensity))
+	publishMQTT(&mqttVibrationDataEnt{
+		Time:      time.Now().Format(time.RFC3339),
+		Host:      hostName,
+		Address:   d.Address,
+		Name:      d.Name,
+		Type:      "OMRONVibration",
+		RSSI:      d.RSSI,
+		Event:     event,
+		Vibration: vibration,
+		SI:        si,
+		PGA:       pga,
+		Intensity: intensity,
+	})
+}
+
+// sendOMRONCalc : 送信した場合はtrueを返す
+func sendOMRONCalc(d *BluetoothDeviceEnt, o *OMRONEnt) bool {
+	if len(o.Calc) < 13 {
+		return false
+	}
+	seq := int(o.Calc[1])
+	di := float64(int(o.Calc[3])*256+int(o.Calc[2])) * 0.01
+	heat := float64(int16(uint16(o.Calc[5])<<8|uint16(o.Calc[4]))) * 0.01
+	if debug {
+		log.Printf("omron seq=%d,di=%.02f,heat=%.02f", seq, di, heat)
+	}
+	e := &mqttEnvDataEnt{
+		Time:       time.Now().Format(time.RFC3339),
+		Host:       hostName,
+		Address:    d.Address,
+		Name:       d.Name,
+		Type:       "OMRONCalc",
+		RSSI:       d.RSSI,
+		Battery:    -1,
+		Discomfort: di,
+		HeatStroke: heat,
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "discomfort", "heat_stroke")) {
+		return false
+	}
+	sendSyslog(fmt.Sprintf("type=OMRONCalc,address=%s,name=%s,rssi=%d,seq=%d,di=%.02f,heat=%.02f",
+		d.Address, d.Name, d.RSSI, seq, di, heat))
+	publishMQTT(e)
+	sendOMRONVibration(d, o, "report")
+	return true
+}
+
+// omronFlagBitNames : フラグのビット毎のイベント(1バイトのフラグは下位8ビット)
+var omronFlagBitNames = []string{
+	"upper1", "upper2", "lower1", "lower2",
+	"rise1", "rise2", "decline1", "decline2",
+	"average_upper", "average_lower", "peak_upper", "peak_lower",
+	"interval_rise", "interval_decline", "base_upper", "base_lower",
+}
+
+// getOMRONFlagBits : 指定位置のフラグのセットされているイベントを返す
+func getOMRONFlagBits(flag []byte, pos, size int) []string {
+	v := int(flag[pos])
+	if size > 1 {
+		v |= int(flag[pos+1]) << 8
+	}
+	var r []string
+	for i := 0; i < size*8; i++ {
+		if v&(1<<i) != 0 {
+			r = append(r, omronFlagBitNames[i])
+		}
+	}
+	return r
+}
+
+func sendOMRONFlag(d *BluetoothDeviceEnt, o *OMRONEnt) {
+	if len(o.Flag) < 23 {
+		return
+	}
+	f := o.Flag
+	e := &mqttOMRONFlagDataEnt{
+		Time:        time.Now().Format(time.RFC3339),
+		Host:        hostName,
+		Address:     d.Address,
+		Name:        d.Name,
+		Type:        "OMRONFlag",
+		RSSI:        d.RSSI,
+		Seq:         int(f[1]),
+		Temperature: getOMRONFlagBits(f, 2, 2),
+		Humidity:    getOMRONFlagBits(f, 4, 2),
+		Light:       getOMRONFlagBits(f, 6, 2),
+		Pressure:    getOMRONFlagBits(f, 8, 2),
+		Noise:       getOMRONFlagBits(f, 10, 2),
+		ETVOC:       getOMRONFlagBits(f, 12, 2),
+		ECO2:        getOMRONFlagBits(f, 14, 2),
+		Discomfort:  getOMRONFlagBits(f, 16, 2),
+		HeatStroke:  getOMRONFlagBits(f, 18, 2),
+		SI:          getOMRONFlagBits(f, 20, 1),
+		PGA:         getOMRONFlagBits(f, 21, 1),
+		Intensity:   getOMRONFlagBits(f, 22, 1),
+	}
+	msg := fmt.Sprintf("type=OMRONFlag,address=%s,name=%s,rssi=%d,seq=%d", d.Address, d.Name, d.RSSI, e.Seq)
+	for _, v := range []struct {
+		Name string
+		Bits []string
+	}{
+		{"temp", e.Temperature}, {"hum", e.Humidity}, {"light", e.Light}, {"press", e.Pressure},
+		{"noise", e.Noise}, {"etvoc", e.ETVOC}, {"eco2", e.ECO2}, {"di", e.Discomfort},
+		{"heat", e.HeatStroke}, {"si", e.SI}, {"pga", e.PGA}, {"intensity", e.Intensity},
+	} {
+		if len(v.Bits) > 0 {
+			msg += fmt.Sprintf(",%s=%s", v.Name, strings.Join(v.Bits, "|"))
+		}
+	}
+	if debug {
+		log.Printf("omron flag %s", msg)
+	}
+	sendSyslog(msg)
+	publishMQTT(e)
+}
+
+// sendOMRON : OMRON環境センサーのレポートを送信する
+// 前回送信時から連番が変わらないデータは送信しない
+func sendOMRON(d *BluetoothDeviceEnt) bool {
+	o := getOMRONEnt(d.Address)
+	if sensorDecoding {
+		// 受信時のデコードでは連番を更新しない
+		if len(d.EnvData) >= 18 && d.EnvData[0] == omronDataSensor {
+			sendOMRONEnv(d)
+		}
+		if o.Calc != nil {
+			sendOMRONCalc(d, o)
+		}
+		return false
+	}
+	sent := false
+	if len(d.EnvData) >= 18 && d.EnvData[0] == omronDataSensor {
+		if seq := int(d.EnvData[1]); seq != o.EnvSeq {
+			// 変化で送信する場合に送信しなかった計測値は次のレポートで判定する
+			if sendOMRONEnv(d) {
+				o.EnvSeq = seq
+				sent = true
+			}
+		} else if debug {
+			log.Printf("omron skip duplicate seq=%d address=%s", seq, d.Address)
+		}
+	}
+	if o.Calc != nil && o.CalcSeq != o.ReportSeq && sendOMRONCalc(d, o) {
+		o.ReportSeq = o.CalcSeq
+		sent = true
+	}
+	if o.Flag != nil && o.FlagSeq != o.FlagSent {
+		o.FlagSent = o.FlagSeq
+		sendOMRONFlag(d, o)
+		sent = true
+	}
+	return sent
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// デバイスの到着と出発
+// RSSIがarriveRSSI以上になると到着、受信しなくなるかRSSIがarriveRSSI-rssiHysteresis未満の状態が
+// awayTimeout秒続くと出発とする
+// 保持期間の設定でレポートの対象となるデバイスのみ(-allを指定した場合は全て)
+
+// checkArrival : 受信時に到着を判定する
+func checkArrival(d *BluetoothDeviceEnt) {
+	if awayTimeout <= 0 || !isReportDevice(d) {
+		return
+	}
+	now := time.Now().Unix()
+	if !d.Present {
+		if d.RSSI >= arriveRSSI {
+			d.Present = true
+			d.ArriveTime = now
+			d.WeakSince = 0
+			sendDevicePresence(d, "arrived")
+		}
+		return
+	}
+	if d.RSSI < arriveRSSI-rssiHysteresis {
+		if d.WeakSince == 0 {
+			d.WeakSince = now
+		}
+	} else {
+		d.WeakSince = 0
+	}
+}
+
+// checkDeparture : 定期的に出発を判定する
+func checkDeparture() {
+	if awayTimeout <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	deviceMap.Range(func(k, v interface{}) bool {
+		d, ok := v.(*BluetoothDeviceEnt)
+		if !ok || !d.Present {
+			return true
+		}
+		if d.LastTime < now-awayTimeout || (d.WeakSince > 0 && d.WeakSince < now-awayTimeout) {
+			setDeparted(d)
+		}
+		return true
+	})
+}
+
+func setDeparted(d *BluetoothDeviceEnt) {
+	if !d.Present {
+		return
+	}
+	d.Present = false
+	d.WeakSince = 0
+	sendDevicePresence(d, "departed")
+}
+
+func sendDevicePresence(d *BluetoothDeviceEnt, event string) {
+	classifyDevice(d)
+	dwell := int64(0)
+	if event == "departed" {
+		dwell = d.LastTime - d.ArriveTime
+	}
+	if debug {
+		log.Printf("device %s address=%s name=%s rssi=%d dwell=%d", event, d.Address, d.Name, d.RSSI, dwell)
+	}
+	sendSyslog(fmt.Sprintf("type=DevicePresence,address=%s,name=%s,rssi=%d,vendor=%s,category=%s,event=%s,dwell=%d,arrive=%s,lt=%s",
+		d.Address, d.Name, d.RSSI, getVendor(d), d.Category, event, dwell,
+		time.Unix(d.ArriveTime, 0).Format(time.RFC3339),
+		time.Unix(d.LastTime, 0).Format(time.RFC3339),
+	))
+	publishMQTT(&mqttDevicePresenceDataEnt{
+		Time:       time.Now().Format(time.RFC3339),
+		Host:       hostName,
+		Address:    d.Address,
+		Name:       d.Name,
+		RSSI:       d.RSSI,
+		Vendor:     getVendor(d),
+		Category:   d.Category,
+		Event:      event,
+		Dwell:      dwell,
+		ArriveTime: time.Unix(d.ArriveTime, 0).Format(time.RFC3339),
+		LastTime:   time.Unix(d.LastTime, 0).Format(time.RFC3339),
+	})
+}
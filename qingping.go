@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Qingping 温湿度計・空気質モニター
+// https://github.com/Bluetooth-Devices/qingping-ble
+// Service Data(0xfdcd)
+// cd fd  UUID
+// 88     Frame Control
+// 16     プロダクトID
+// xx xx xx xx xx xx  MACアドレス
+// 以降はオブジェクト(ID,長さ,値)の繰り返し
+// 01 04 e6 00 86 01  温度 0.1℃,湿度 0.1%
+// 02 01 64           バッテリー 1%
+// 07 02 ec 27        気圧 0.1hPa
+// 12 04 0a 00 0f 00  PM2.5,PM10 1ug/m3
+// 13 02 c2 01        CO2 1ppm
+// PM1のオブジェクトはないため、mqttEnvDataEntのPM1は送信しない
+
+// qingpingModelMap : プロダクトIDとモデル名の対応表
+var qingpingModelMap = map[uint8]string{
+	0x01: "CGG1",
+	0x07: "CGG1",
+	0x09: "CGP1W",
+	0x0c: "CGD1",
+	0x0e: "CGDN1",
+	0x10: "CGDK2",
+	0x12: "CGPR1",
+	0x24: "CGDN1",
+}
+
+// getQingpingModelName : 未知のプロダクトIDは16進数で返す
+func getQingpingModelName(id uint8) string {
+	if m, ok := qingpingModelMap[id]; ok {
+		return m
+	}
+	return fmt.Sprintf("%02x", id)
+}
+
+func isQingpingData(data []byte) bool {
+	return len(data) > 12 && data[0] == 0xcd && data[1] == 0xfd
+}
+
+func sendQingpingEnv(d *BluetoothDeviceEnt) {
+	if !isQingpingData(d.EnvData) {
+		return
+	}
+	e := &mqttEnvDataEnt{
+		Time:    time.Now().Format(time.RFC3339),
+		Host:    hostName,
+		Address: d.Address,
+		Name:    d.Name,
+		Type:    "QingpingEnv",
+		Model:   getQingpingModelName(d.EnvData[3]),
+		RSSI:    d.RSSI,
+		Battery: -1,
+	}
+	msg := ""
+	var metrics []string
+	for i := 10; i+1 < len(d.EnvData); {
+		id := d.EnvData[i]
+		l := int(d.EnvData[i+1])
+		v := d.EnvData[i+2:]
+		if len(v) < l {
+			break
+		}
+		switch {
+		case id == 0x01 && l == 4:
+			e.Temperature = float64(int16(uint16(v[1])<<8|uint16(v[0]))) / 10.0
+			e.Humidity = float64(int(v[3])*256+int(v[2])) / 10.0
+			msg += fmt.Sprintf(",temp=%.02f,hum=%.02f", e.Temperature, e.Humidity)
+			metrics = append(metrics, "temperature", "humidity")
+		case id == 0x02 && l == 1:
+			e.Battery = int(v[0])
+			msg += fmt.Sprintf(",bat=%d", e.Battery)
+			metrics = append(metrics, "battery")
+		case id == 0x07 && l == 2:
+			e.Pressure = float64(int(v[1])*256+int(v[0])) / 10.0
+			msg += fmt.Sprintf(",press=%.02f", e.Pressure)
+			metrics = append(metrics, "pressure")
+		case id == 0x12 && l == 4:
+			e.PM25 = int(v[1])*256 + int(v[0])
+			e.PM10 = int(v[3])*256 + int(v[2])
+			msg += fmt.Sprintf(",pm25=%d,pm10=%d", e.PM25, e.PM10)
+			metrics = append(metrics, "pm25", "pm10")
+		case id == 0x13 && l == 2:
+			e.Co2 = int(v[1])*256 + int(v[0])
+			msg += fmt.Sprintf(",co2=%d", e.Co2)
+			metrics = append(metrics, "co2")
+		default:
+			if debug {
+				log.Printf("qingping unknown object id=%02x data=%x", id, v[:l])
+			}
+		}
+		i += 2 + l
+	}
+	if msg == "" {
+		return
+	}
+	if debug {
+		log.Printf("qingping model=%s%s", e.Model, msg)
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, metrics...)) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=QingpingEnv,address=%s,name=%s,rssi=%d,model=%s%s",
+		d.Address, d.Name, d.RSSI, e.Model, msg))
+	publishMQTT(e)
+}
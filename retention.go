@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// デバイスの種類毎のレポートと保持期間
+// "random=off/890,named=600/86400,watched=0/604800"
+// 種類=レポートを停止する時間(秒)/削除する時間(秒)
+// レポートを停止する時間が0は前回のレポート以降に受信したもの、offはレポートしない
+const (
+	classWatched = "watched"
+	classSensor  = "sensor"
+	classFixed   = "fixed"
+	classNamed   = "named"
+	classRandom  = "random"
+)
+
+var retentionClassList = []string{classWatched, classSensor, classFixed, classNamed, classRandom}
+
+type RetentionPolicyEnt struct {
+	Report     bool
+	StopReport int64
+	Forget     int64
+}
+
+var retentionPolicyMap = map[string]*RetentionPolicyEnt{
+	classWatched: {Report: true, StopReport: 0, Forget: 60 * 60 * 48},
+	classSensor:  {Report: true, StopReport: 0, Forget: 60 * 60 * 48},
+	classFixed:   {Report: true, StopReport: 0, Forget: 60 * 60 * 48},
+	classNamed:   {Report: true, StopReport: 0, Forget: 60 * 60 * 48},
+	classRandom:  {Report: false, StopReport: 0, Forget: 15*60 - 10},
+}
+
+var watchMap = make(map[string]bool)
+
+func parseRetentionConf(s string) {
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		a := strings.SplitN(e, "=", 2)
+		if len(a) != 2 {
+			log.Fatalf("invalid retention=%s", e)
+		}
+		p, ok := retentionPolicyMap[strings.TrimSpace(a[0])]
+		if !ok {
+			log.Fatalf("invalid retention class=%s", a[0])
+		}
+		t := strings.SplitN(a[1], "/", 2)
+		if len(t) != 2 {
+			log.Fatalf("invalid retention=%s", e)
+		}
+		if t[0] == "off" {
+			p.Report = false
+			p.StopReport = 0
+		} else if v, err := strconv.ParseInt(t[0], 10, 64); err == nil && v >= 0 {
+			p.Report = true
+			p.StopReport = v
+		} else {
+			log.Fatalf("invalid retention=%s", e)
+		}
+		if v, err := strconv.ParseInt(t[1], 10, 64); err == nil && v > 0 {
+			p.Forget = v
+		} else {
+			log.Fatalf("invalid retention=%s", e)
+		}
+	}
+}
+
+func parseWatchList(s string) {
+	for _, a := range strings.Split(s, ",") {
+		a = normalizeID(a)
+		if a != "" {
+			watchMap[a] = true
+		}
+	}
+}
+
+// getDeviceClass : 保持期間を決めるデバイスの種類
+func getDeviceClass(d *BluetoothDeviceEnt) string {
+	switch {
+	case watchMap[normalizeID(d.Address)] || (d.Identity != "" && watchMap[normalizeID(d.Identity)]):
+		return classWatched
+	case len(d.EnvData) > 0 || d.SBType != 0:
+		return classSensor
+	case d.FixedAddr || d.Identity != "":
+		return classFixed
+	case d.Name != "":
+		return classNamed
+	}
+	return classRandom
+}
+
+func getRetentionPolicy(d *BluetoothDeviceEnt) *RetentionPolicyEnt {
+	return retentionPolicyMap[getDeviceClass(d)]
+}
+
+// isReportDevice : レポートの対象となるデバイス
+func isReportDevice(d *BluetoothDeviceEnt) bool {
+	return allAddress || getRetentionPolicy(d).Report
+}
+
+// isSendDevice : レポートで送信するデバイス(分類のフィルターを含む)
+func isSendDevice(d *BluetoothDeviceEnt) bool {
+	if d.Category == "" {
+		classifyDevice(d)
+	}
+	return isReportDevice(d) && isReportCategory(d.Category)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 許可リストにない固定アドレスまたは名前のあるデバイスの検知
+// 許可リストのファイルは1行に1つのアドレス、IRKのID、ビーコンID(#以降はコメント)
+// ビーコンIDは iBeaconが UUID-Major-Minor、Eddystone-UIDが Namespace-Instance
+// RSSIがrogueRSSI以上の状態がrogueDuration秒続いたらアラートを送信する
+const rogueGap int64 = 30
+
+var allowMap = make(map[string]bool)
+
+func loadAllowList(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("load allow list err=%v", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		l = normalizeID(l)
+		if l != "" {
+			allowMap[l] = true
+		}
+	}
+	if len(allowMap) < 1 {
+		log.Fatalf("empty allow list=%s", path)
+	}
+	log.Printf("load allow list=%d", len(allowMap))
+}
+
+// getIBeaconID : iBeaconのUUID-Major-Minor
+// 4c 00 02 15 UUID(16) Major(2) Minor(2) TX Power(1)
+func getIBeaconID(data []byte) string {
+	if len(data) != 25 || data[2] != 0x02 || data[3] != 0x15 {
+		return ""
+	}
+	id, err := uuid.FromBytes(data[4:20])
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d-%d", id.String(), int(data[20])*256+int(data[21]), int(data[22])*256+int(data[23]))
+}
+
+// getEddystoneID : Eddystone-UIDのNamespace-Instance
+// aa fe 00 TX Power(1) Namespace(10) Instance(6)
+func getEddystoneID(data []byte) string {
+	if len(data) < 20 || data[0] != 0xaa || data[1] != 0xfe || data[2] != 0x00 {
+		return ""
+	}
+	return hex.EncodeToString(data[4:14]) + "-" + hex.EncodeToString(data[14:20])
+}
+
+func isAllowedDevice(d *BluetoothDeviceEnt) bool {
+	return allowMap[normalizeID(d.Address)] ||
+		(d.Identity != "" && allowMap[normalizeID(d.Identity)]) ||
+		(d.BeaconID != "" && allowMap[normalizeID(d.BeaconID)])
+}
+
+// checkRogue : 受信時に許可されていないデバイスを検知する
+func checkRogue(d *BluetoothDeviceEnt) {
+	if len(allowMap) < 1 || (!d.FixedAddr && d.Name == "") || isAllowedDevice(d) {
+		return
+	}
+	if getFilteredRSSI(d) < float64(rogueRSSI) {
+		return
+	}
+	now := time.Now().Unix()
+	if d.RogueSince == 0 || d.RogueLast < now-rogueGap {
+		d.RogueSince = now
+		d.RogueAlerted = false
+	}
+	d.RogueLast = now
+	if d.RogueAlerted || now-d.RogueSince < rogueDuration {
+		return
+	}
+	d.RogueAlerted = true
+	classifyDevice(d)
+	vendor := getVendor(d)
+	duration := now - d.RogueSince
+	sendAlert(&mqttAlertDataEnt{
+		Type:     "rogue",
+		Event:    "detected",
+		Severity: "warning",
+		Address:  d.Address,
+		Name:     d.Name,
+		RSSI:     d.RSSI,
+		Vendor:   vendor,
+		Category: d.Category,
+		Duration: duration,
+	}, fmt.Sprintf(",vendor=%s,category=%s,addrType=%s,duration=%d", vendor, d.Category, d.AddressType, duration))
+}
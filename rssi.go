@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+)
+
+// RSSIの統計とフィルター
+// 統計(サンプル数、平均、中央値、標準偏差)はレポート毎にリセットする
+// 中央値はヒストグラムから求めるのでメモリは一定
+// EMAとカルマンフィルターの値はリセットしない
+const (
+	rssiEMAAlpha    = 0.3
+	rssiKalmanQ     = 0.5
+	rssiKalmanR     = 8.0
+	rssiHistMin     = -127
+	rssiHistBuckets = 128
+)
+
+type RSSIStatsEnt struct {
+	Count  int
+	Sum    float64
+	SumSq  float64
+	Hist   [rssiHistBuckets]uint32
+	EMA    float64
+	Kalman float64
+	P      float64
+}
+
+func (s *RSSIStatsEnt) add(rssi int) {
+	v := float64(rssi)
+	s.Count++
+	s.Sum += v
+	s.SumSq += v * v
+	s.Hist[max(0, min(rssiHistBuckets-1, rssi-rssiHistMin))]++
+	if s.P == 0 {
+		s.EMA = v
+		s.Kalman = v
+		s.P = 1
+		return
+	}
+	s.EMA += rssiEMAAlpha * (v - s.EMA)
+	// 1次元のカルマンフィルター(RSSIは一定値+雑音のモデル)
+	p := s.P + rssiKalmanQ
+	k := p / (p + rssiKalmanR)
+	s.Kalman += k * (v - s.Kalman)
+	s.P = (1 - k) * p
+}
+
+// reset : レポート毎の統計をリセットする
+func (s *RSSIStatsEnt) reset() {
+	s.Count = 0
+	s.Sum = 0
+	s.SumSq = 0
+	s.Hist = [rssiHistBuckets]uint32{}
+}
+
+func (s *RSSIStatsEnt) mean() float64 {
+	if s.Count < 1 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+func (s *RSSIStatsEnt) median() int {
+	if s.Count < 1 {
+		return 0
+	}
+	n := uint32(0)
+	for i, c := range s.Hist {
+		n += c
+		if int(n)*2 >= s.Count {
+			return i + rssiHistMin
+		}
+	}
+	return 0
+}
+
+func (s *RSSIStatsEnt) stddev() float64 {
+	if s.Count < 2 {
+		return 0
+	}
+	m := s.mean()
+	return math.Sqrt(max(0, s.SumSq/float64(s.Count)-m*m))
+}
+
+// getFilteredRSSI : カルマンフィルターで平滑化したRSSI
+func getFilteredRSSI(d *BluetoothDeviceEnt) float64 {
+	if d.RSSIStats.P == 0 {
+		return float64(d.RSSI)
+	}
+	return d.RSSIStats.Kalman
+}
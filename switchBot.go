@@ -0,0 +1,599 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SwitchBotのService Data(0x3dfd)の3バイト目のデバイスタイプ
+const (
+	switchBotCode  = 0x0969
+	sbTypeMotion   = 0x73 // 's' Motion Sensor
+	sbTypeContact  = 0x64 // 'd' Contact Sensor
+	sbTypeLeak     = 0x26 // '&' Water Leak Detector
+	sbTypePresence = 0x7a // 'z' Presence Sensor
+	sbTypeBot      = 0x48 // 'H' Bot
+	sbTypeCurtain  = 0x63 // 'c' Curtain
+	sbTypeCurtain3 = 0x7b // '{' Curtain 3
+	sbTypeBlind    = 0x78 // 'x' Blind Tilt
+	sbTypeLock     = 0x6f // 'o' Lock
+	sbTypeLockPro  = 0x24 // '$' Lock Pro
+)
+
+// switchBotModelMap : デバイスタイプとモデル名の対応表
+// https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/tree/latest/devicetypes
+var switchBotModelMap = map[uint8]string{
+	0x54:           "Meter",
+	0x69:           "MeterPlus",
+	0x77:           "OutdoorMeter",
+	0x34:           "MeterPro",
+	0x35:           "MeterProCO2",
+	0x76:           "Hub2",
+	0x67:           "PlugMini",
+	0x6a:           "PlugMiniJP",
+	sbTypeMotion:   "MotionSensor",
+	sbTypeContact:  "ContactSensor",
+	sbTypeLeak:     "WaterLeakDetector",
+	sbTypePresence: "PresenceSensor",
+	sbTypeBot:      "Bot",
+	sbTypeCurtain:  "Curtain",
+	sbTypeCurtain3: "Curtain3",
+	sbTypeBlind:    "BlindTilt",
+	sbTypeLock:     "Lock",
+	sbTypeLockPro:  "LockPro",
+}
+
+// getSwitchBotType : デバイスタイプを取得する
+func getSwitchBotType(d *BluetoothDeviceEnt) uint8 {
+	if d.Code != switchBotCode && len(d.SBData) < 1 {
+		return 0
+	}
+	if _, ok := switchBotModelMap[d.SBType]; ok {
+		return d.SBType
+	}
+	if d.SBType == 0 && !active && d.Code == switchBotCode {
+		// パッシブスキャンではデバイスタイプを含むScan Responseを受信できないため
+		// Manufacturer Specific Dataの長さで判別できるモデルだけ扱う
+		if t, ok := switchBotMfgLenMap[len(d.EnvData)+9]; ok {
+			return t
+		}
+	}
+	return 0
+}
+
+// switchBotMfgLenMap : パッシブスキャンで判別するManufacturer Specific Data(Company ID含む)の長さとデバイスタイプ
+// Hub 2とMeter Pro CO2はどちらも18バイトで長さでは区別できないため、アクティブスキャンでだけ判別する
+var switchBotMfgLenMap = map[int]uint8{
+	14: 0x67, // Plug Mini
+}
+
+func getSwitchBotModelName(d *BluetoothDeviceEnt) string {
+	if m, ok := switchBotModelMap[getSwitchBotType(d)]; ok {
+		return m
+	}
+	if len(d.EnvData) == 8 && d.EnvData[0] == 0 && d.EnvData[1] == 0x0d && d.EnvData[2] == 0x54 {
+		return "Meter"
+	}
+	return ""
+}
+
+// sendSwitchBot : モデル毎のデコード処理で送信する
+// イベント型センサーとアクチュエーターは個別に送信するため対象外
+func sendSwitchBot(d *BluetoothDeviceEnt) bool {
+	switch t := getSwitchBotType(d); t {
+	case 0x54, 0x69:
+		sendSwitchBotEnv(d)
+	case 0x77, 0x34:
+		sendSwitchBotIP64(d)
+	case 0x35:
+		sendSwitchBotCo2(d)
+	case 0x76:
+		sendSwitchBotHub2(d)
+	case 0x67, 0x6a:
+		sendSwitchBotPlugMini(d)
+	default:
+		if t == 0 && debug && (d.Code == switchBotCode || len(d.SBData) > 0) {
+			log.Printf("unknown switchbot type=%02x d=%+v", d.SBType, d)
+		}
+		return false
+	}
+	return true
+}
+
+// Hub 2
+// Manufacturer Specific Data(EnvData)
+// xx xx xx xx xx  不明
+// 0a     bit0-4=明るさレベル(1-20)
+// 05 97 35  温度(bit0-3=小数点以下,bit0-6=整数 bit7=符号) 湿度 bit0-6
+func sendSwitchBotHub2(d *BluetoothDeviceEnt) {
+	if len(d.EnvData) < 9 {
+		return
+	}
+	model := getSwitchBotModelName(d)
+	light := int(d.EnvData[5] & 0x1f)
+	temp := float64(int(d.EnvData[6]&0x0f))/10.0 + float64(d.EnvData[7]&0x7f)
+	if (d.EnvData[7] & 0x80) != 0x80 {
+		temp *= -1.0
+	}
+	hum := float64(int(d.EnvData[8] & 0x7f))
+	if debug {
+		log.Printf("switchbot model=%s,temp=%.02f,hum=%.02f,light=%d", model, temp, hum, light)
+	}
+	e := &mqttEnvDataEnt{
+		Time:        time.Now().Format(time.RFC3339),
+		Host:        hostName,
+		Address:     d.Address,
+		Name:        d.Name,
+		Type:        "SwitchBotEnv",
+		Model:       model,
+		RSSI:        d.RSSI,
+		Temperature: temp,
+		Humidity:    hum,
+		Lux:         light,
+		Battery:     -1,
+	}
+	if !checkSensorData(d, e.Type, getEnvValues(e, "temperature", "humidity", "lux")) {
+		return
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotEnv,address=%s,name=%s,rssi=%d,model=%s,temp=%.02f,hum=%.02f,light=%d",
+		d.Address, d.Name, d.RSSI, model,
+		temp, hum, light,
+	))
+	publishMQTT(e)
+}
+
+// isSwitchBotServiceData : Service DataがSwitchBot(0x3dfd)の指定タイプか判定する
+func isSwitchBotServiceData(data []byte, t uint8) bool {
+	return len(data) > 3 && data[0] == 0x3d && data[1] == 0xfd && data[2]&0x7f == t
+}
+
+// getDeviceEnt : 受信したアドレスのデバイス(IRKで解決したRPAはIDで検索する)
+func getDeviceEnt(addr string) *BluetoothDeviceEnt {
+	if id := rpaCache[addr]; id != "" {
+		addr = id
+	}
+	if v, ok := deviceMap.Load(addr); ok {
+		if d, ok := v.(*BluetoothDeviceEnt); ok {
+			return d
+		}
+	}
+	return nil
+}
+
+type ContactSensorEnt struct {
+	Address        string
+	Open           bool
+	Timeout        bool
+	Moving         bool
+	Light          bool
+	Button         int
+	Entrance       int
+	Exit           int
+	Direction      string
+	LastChangeDiff int64
+	Battery        int
+}
+
+var contactSensorMap sync.Map
+
+// Contact Sensor Broadcast
+// https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/blob/latest/devicetypes/contactsensor.md
+// 3d fd  UUID
+// 64     デバイスタイプ
+// 40     bit6=人感センサー
+// e4     バッテリー bit0-6
+// 02     bit1-2=開閉状態(0=閉,1=開,3=開いたまま) bit0=明るさ
+// 00 10  人感センサー検知からの経過時間 1秒
+// 00 20  開閉からの経過時間 1秒
+// 51     bit6-7=入室カウンター bit4-5=退室カウンター bit0-3=ボタンカウンター
+func checkSwitchBotContact(d *BluetoothDeviceEnt, data []byte) {
+	if len(data) < 11 {
+		return
+	}
+	open := data[5]&0x02 == 0x02
+	timeout := data[5]&0x06 == 0x06
+	moving := data[3]&0x40 == 0x40
+	light := data[5]&0x01 == 0x01
+	diff := int64(data[8])*256 + int64(data[9])
+	button := int(data[10] & 0x0f)
+	entrance := int(data[10]>>6) & 0x03
+	exit := int(data[10]>>4) & 0x03
+	bat := int(data[4] & 0x7f)
+	if v, ok := contactSensorMap.Load(d.Address); ok {
+		if cs, ok := v.(*ContactSensorEnt); ok {
+			events := []string{}
+			if cs.Open != open {
+				if open {
+					events = append(events, "opened")
+				} else {
+					events = append(events, "closed")
+				}
+			}
+			if cs.Button != button {
+				events = append(events, "button")
+			}
+			if cs.Entrance != entrance {
+				cs.Direction = "entrance"
+				events = append(events, "entrance")
+			} else if cs.Exit != exit {
+				cs.Direction = "exit"
+				events = append(events, "exit")
+			}
+			cs.Open = open
+			cs.Timeout = timeout
+			cs.Moving = moving
+			cs.Light = light
+			cs.Button = button
+			cs.Entrance = entrance
+			cs.Exit = exit
+			cs.LastChangeDiff = diff
+			cs.Battery = bat
+			for _, e := range events {
+				sendContactSensor(d, cs, e)
+			}
+		}
+		return
+	}
+	cs := &ContactSensorEnt{
+		Address:        d.Address,
+		Open:           open,
+		Timeout:        timeout,
+		Moving:         moving,
+		Light:          light,
+		Button:         button,
+		Entrance:       entrance,
+		Exit:           exit,
+		LastChangeDiff: diff,
+		Battery:        bat,
+	}
+	contactSensorMap.Store(d.Address, cs)
+	sendContactSensor(d, cs, "new")
+}
+
+func sendContactSensor(d *BluetoothDeviceEnt, cs *ContactSensorEnt, event string) {
+	if debug {
+		log.Printf("switchbot contact sensor %s %+v %+v", event, d, cs)
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotContactSensor,address=%s,name=%s,rssi=%d,open=%v,timeout=%v,event=%s,lastChangeDiff=%d,button=%d,entrance=%d,exit=%d,direction=%s,moving=%v,light=%v,battery=%d",
+		cs.Address, d.Name, d.RSSI, cs.Open, cs.Timeout, event, cs.LastChangeDiff,
+		cs.Button, cs.Entrance, cs.Exit, cs.Direction, cs.Moving, cs.Light, cs.Battery))
+	publishMQTT(&mqttContactSensorDataEnt{
+		Time:           time.Now().Format(time.RFC3339),
+		Host:           hostName,
+		Address:        cs.Address,
+		Name:           d.Name,
+		Type:           "SwitchBotContactSensor",
+		RSSI:           d.RSSI,
+		Event:          event,
+		Open:           cs.Open,
+		Timeout:        cs.Timeout,
+		LastChangeDiff: cs.LastChangeDiff,
+		Button:         cs.Button,
+		Entrance:       cs.Entrance,
+		Exit:           cs.Exit,
+		Direction:      cs.Direction,
+		Moving:         cs.Moving,
+		Light:          cs.Light,
+		Battery:        cs.Battery,
+	})
+}
+
+type LeakSensorEnt struct {
+	Address  string
+	Leak     bool
+	Tampered bool
+	Battery  int
+}
+
+var leakSensorMap sync.Map
+
+// Water Leak Detector
+// 状態はManufacturer Specific Data(0x0969)に格納される
+// EnvData(MACアドレスとシーケンス番号の後)
+// 64     バッテリー bit0-6
+// 01     bit0=漏水検知 bit1=いたずら検知
+func checkSwitchBotLeak(d *BluetoothDeviceEnt) {
+	if len(d.EnvData) < 2 {
+		return
+	}
+	leak := d.EnvData[1]&0x01 == 0x01
+	tampered := d.EnvData[1]&0x02 == 0x02
+	bat := int(d.EnvData[0] & 0x7f)
+	if v, ok := leakSensorMap.Load(d.Address); ok {
+		if ls, ok := v.(*LeakSensorEnt); ok {
+			send := ls.Leak != leak
+			ls.Leak = leak
+			ls.Tampered = tampered
+			ls.Battery = bat
+			if send {
+				if leak {
+					sendLeakSensor(d, ls, "leak")
+				} else {
+					sendLeakSensor(d, ls, "dry")
+				}
+			}
+		}
+		return
+	}
+	ls := &LeakSensorEnt{
+		Address:  d.Address,
+		Leak:     leak,
+		Tampered: tampered,
+		Battery:  bat,
+	}
+	leakSensorMap.Store(d.Address, ls)
+	sendLeakSensor(d, ls, "new")
+}
+
+func sendLeakSensor(d *BluetoothDeviceEnt, ls *LeakSensorEnt, event string) {
+	if debug {
+		log.Printf("switchbot leak sensor %s %+v %+v", event, d, ls)
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotLeakSensor,address=%s,name=%s,rssi=%d,leak=%v,event=%s,tampered=%v,battery=%d",
+		ls.Address, d.Name, d.RSSI, ls.Leak, event, ls.Tampered, ls.Battery))
+	publishMQTT(&mqttLeakSensorDataEnt{
+		Time:     time.Now().Format(time.RFC3339),
+		Host:     hostName,
+		Address:  ls.Address,
+		Name:     d.Name,
+		Type:     "SwitchBotLeakSensor",
+		RSSI:     d.RSSI,
+		Event:    event,
+		Leak:     ls.Leak,
+		Tampered: ls.Tampered,
+		Battery:  ls.Battery,
+	})
+}
+
+type PresenceSensorEnt struct {
+	Address    string
+	Presence   bool
+	LastChange int64
+	Light      int
+	Battery    int
+}
+
+var presenceSensorMap sync.Map
+
+// Presence Sensor Broadcast
+// 3d fd  UUID
+// 7a     デバイスタイプ
+// 40     bit6=在室
+// e4     バッテリー bit0-6
+// 00 10  在室状態の変化からの経過時間 1秒
+// 02     bit0-1=明るさレベル
+func checkSwitchBotPresence(d *BluetoothDeviceEnt, data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	presence := data[3]&0x40 == 0x40
+	bat := int(data[4] & 0x7f)
+	diff := int64(data[5])*256 + int64(data[6])
+	light := int(data[7] & 0x03)
+	if v, ok := presenceSensorMap.Load(d.Address); ok {
+		if ps, ok := v.(*PresenceSensorEnt); ok {
+			send := ps.Presence != presence
+			ps.Presence = presence
+			ps.LastChange = time.Now().Unix() - diff
+			ps.Light = light
+			ps.Battery = bat
+			if send {
+				if presence {
+					sendPresenceSensor(d, ps, "present")
+				} else {
+					sendPresenceSensor(d, ps, "absent")
+				}
+			}
+		}
+		return
+	}
+	ps := &PresenceSensorEnt{
+		Address:    d.Address,
+		Presence:   presence,
+		LastChange: time.Now().Unix() - diff,
+		Light:      light,
+		Battery:    bat,
+	}
+	presenceSensorMap.Store(d.Address, ps)
+	sendPresenceSensor(d, ps, "new")
+}
+
+func sendPresenceSensor(d *BluetoothDeviceEnt, ps *PresenceSensorEnt, event string) {
+	if debug {
+		log.Printf("switchbot presence sensor %s %+v %+v", event, d, ps)
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotPresenceSensor,address=%s,name=%s,rssi=%d,presence=%v,event=%s,lastChange=%s,light=%d,battery=%d",
+		ps.Address, d.Name, d.RSSI, ps.Presence, event, time.Unix(ps.LastChange, 0).Format(time.RFC3339), ps.Light, ps.Battery))
+	publishMQTT(&mqttPresenceSensorDataEnt{
+		Time:       time.Now().Format(time.RFC3339),
+		Host:       hostName,
+		Address:    ps.Address,
+		Name:       d.Name,
+		Type:       "SwitchBotPresenceSensor",
+		RSSI:       d.RSSI,
+		Event:      event,
+		Presence:   ps.Presence,
+		LastChange: ps.LastChange,
+		Light:      ps.Light,
+		Battery:    ps.Battery,
+	})
+}
+
+// sendSwitchBotSensorReport : イベント型センサーとアクチュエーターの定期レポート
+// checkは10秒毎のチェックからの呼び出し(変化で送信する種類のheartbeat)
+func sendSwitchBotSensorReport(check bool) {
+	motionSensorMap.Range(func(k, v interface{}) bool {
+		if ms, ok := v.(*MotionSensorEnt); ok {
+			if d := getDeviceEnt(ms.Address); d != nil && isHeartbeatDue(d, "SwitchBotMotionSensor", check) {
+				sendMotionSensor(ms, "report")
+			}
+		}
+		return true
+	})
+	contactSensorMap.Range(func(k, v interface{}) bool {
+		if cs, ok := v.(*ContactSensorEnt); ok {
+			if d := getDeviceEnt(cs.Address); d != nil && isHeartbeatDue(d, "SwitchBotContactSensor", check) {
+				sendContactSensor(d, cs, "report")
+			}
+		}
+		return true
+	})
+	leakSensorMap.Range(func(k, v interface{}) bool {
+		if ls, ok := v.(*LeakSensorEnt); ok {
+			if d := getDeviceEnt(ls.Address); d != nil && isHeartbeatDue(d, "SwitchBotLeakSensor", check) {
+				sendLeakSensor(d, ls, "report")
+			}
+		}
+		return true
+	})
+	presenceSensorMap.Range(func(k, v interface{}) bool {
+		if ps, ok := v.(*PresenceSensorEnt); ok {
+			if d := getDeviceEnt(ps.Address); d != nil && isHeartbeatDue(d, "SwitchBotPresenceSensor", check) {
+				sendPresenceSensor(d, ps, "report")
+			}
+		}
+		return true
+	})
+	actuatorMap.Range(func(k, v interface{}) bool {
+		if a, ok := v.(*ActuatorEnt); ok {
+			if d := getDeviceEnt(a.Address); d != nil && isHeartbeatDue(d, "SwitchBotActuator", check) {
+				sendActuator(d, a, "report")
+			}
+		}
+		return true
+	})
+}
+
+type ActuatorEnt struct {
+	Address    string
+	Model      string
+	State      string
+	Mode       string
+	Position   int
+	Moving     bool
+	Calibrated bool
+	DoorOpen   bool
+	Battery    int
+}
+
+var actuatorMap sync.Map
+
+func isSwitchBotActuator(t uint8) bool {
+	switch t {
+	case sbTypeBot, sbTypeCurtain, sbTypeCurtain3, sbTypeBlind, sbTypeLock, sbTypeLockPro:
+		return true
+	}
+	return false
+}
+
+var lockStatusNames = []string{"locked", "unlocked", "locking", "unlocking", "jammed", "jammed", "not_fully_locked"}
+
+// checkSwitchBotActuator : Bot/Curtain/Blind Tilt/Lockの状態を取得する
+// https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/tree/latest/devicetypes
+// Bot,CurtainはService Data、Blind Tilt,LockはManufacturer Specific Data(EnvData)に状態を格納する
+func checkSwitchBotActuator(d *BluetoothDeviceEnt, data []byte) {
+	a := &ActuatorEnt{
+		Address:  d.Address,
+		Position: -1,
+		Battery:  -1,
+	}
+	if len(data) > 4 {
+		a.Battery = int(data[4] & 0x7f)
+	}
+	a.Model = getSwitchBotModelName(d)
+	switch d.SBType {
+	case sbTypeBot:
+		// 3d fd 48 | bit7=モード(0=押す,1=スイッチ) bit6=状態(0=ON) | バッテリー
+		if len(data) < 5 {
+			return
+		}
+		a.Mode = "press"
+		a.State = "off"
+		if data[3]&0x80 == 0x80 {
+			a.Mode = "switch"
+			if data[3]&0x40 != 0x40 {
+				a.State = "on"
+			}
+		}
+	case sbTypeCurtain, sbTypeCurtain3:
+		// 3d fd 63 | bit6=キャリブレーション済み | バッテリー | bit7=動作中 bit0-6=位置 | bit4-7=明るさ
+		if len(data) < 6 {
+			return
+		}
+		a.Calibrated = data[3]&0x40 == 0x40
+		a.Moving = data[5]&0x80 == 0x80
+		a.Position = min(int(data[5]&0x7f), 100)
+	case sbTypeBlind:
+		// EnvData: bit0=キャリブレーション済み | bit7=動作中 bit0-6=角度
+		if len(d.EnvData) < 2 {
+			return
+		}
+		a.Calibrated = d.EnvData[0]&0x01 == 0x01
+		a.Moving = d.EnvData[1]&0x80 == 0x80
+		a.Position = min(int(d.EnvData[1]&0x7f), 100)
+	case sbTypeLock, sbTypeLockPro:
+		// EnvData: bit7=キャリブレーション済み bit4-6=状態 bit2=ドア開
+		if len(d.EnvData) < 1 {
+			return
+		}
+		a.Calibrated = d.EnvData[0]&0x80 == 0x80
+		a.DoorOpen = d.EnvData[0]&0x04 == 0x04
+		st := int(d.EnvData[0]>>4) & 0x07
+		if st < len(lockStatusNames) {
+			a.State = lockStatusNames[st]
+		}
+	default:
+		return
+	}
+	switch d.SBType {
+	case sbTypeCurtain, sbTypeCurtain3, sbTypeBlind:
+		if a.Moving {
+			a.State = "moving"
+		} else {
+			a.State = "stopped"
+		}
+	}
+	if v, ok := actuatorMap.Load(d.Address); ok {
+		if old, ok := v.(*ActuatorEnt); ok {
+			if a.Battery < 0 {
+				a.Battery = old.Battery
+			}
+			send := old.State != a.State || old.Mode != a.Mode || old.DoorOpen != a.DoorOpen ||
+				(!a.Moving && old.Position != a.Position)
+			*old = *a
+			if send {
+				sendActuator(d, old, "change")
+			}
+		}
+		return
+	}
+	actuatorMap.Store(d.Address, a)
+	sendActuator(d, a, "new")
+}
+
+func sendActuator(d *BluetoothDeviceEnt, a *ActuatorEnt, event string) {
+	if debug {
+		log.Printf("switchbot actuator %s %+v %+v", event, d, a)
+	}
+	sendSyslog(fmt.Sprintf("type=SwitchBotActuator,address=%s,name=%s,rssi=%d,model=%s,state=%s,event=%s,mode=%s,position=%d,moving=%v,calibrated=%v,doorOpen=%v,battery=%d",
+		a.Address, d.Name, d.RSSI, a.Model, a.State, event, a.Mode, a.Position, a.Moving, a.Calibrated, a.DoorOpen, a.Battery))
+	publishMQTT(&mqttActuatorDataEnt{
+		Time:       time.Now().Format(time.RFC3339),
+		Host:       hostName,
+		Address:    a.Address,
+		Name:       d.Name,
+		Type:       "SwitchBotActuator",
+		RSSI:       d.RSSI,
+		Event:      event,
+		Model:      a.Model,
+		State:      a.State,
+		Mode:       a.Mode,
+		Position:   a.Position,
+		Moving:     a.Moving,
+		Calibrated: a.Calibrated,
+		DoorOpen:   a.DoorOpen,
+		Battery:    a.Battery,
+	})
+}
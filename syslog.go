@@ -9,7 +9,21 @@ import (
 	"time"
 )
 
-var syslogCh = make(chan string, 2000)
+// syslogのSeverity
+const (
+	syslogCrit    = 2
+	syslogErr     = 3
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+type syslogMsgEnt struct {
+	Severity int
+	Msg      string
+}
+
+var syslogCh = make(chan syslogMsgEnt, 2000)
 var syslogCount = 0
 
 func startSyslog(ctx context.Context) {
@@ -39,7 +53,7 @@ func startSyslog(ctx context.Context) {
 			return
 		case msg := <-syslogCh:
 			syslogCount++
-			s := fmt.Sprintf("<%d>%s %s twBlueScan: %s", 21*8+6, time.Now().Format("2006-01-02T15:04:05-07:00"), hostName, msg)
+			s := fmt.Sprintf("<%d>%s %s twBlueScan: %s", 21*8+msg.Severity, time.Now().Format("2006-01-02T15:04:05-07:00"), hostName, msg.Msg)
 			for _, d := range dst {
 				d.Write([]byte(s))
 			}
@@ -48,8 +62,13 @@ func startSyslog(ctx context.Context) {
 }
 
 func sendSyslog(msg string) {
+	sendSyslogWithSeverity(msg, syslogInfo)
+}
+
+// sendSyslogWithSeverity : アラートなどSeverityを指定して送信する
+func sendSyslogWithSeverity(msg string, severity int) {
 	select {
-	case syslogCh <- msg:
+	case syslogCh <- syslogMsgEnt{Severity: severity, Msg: msg}:
 	default:
 		if debug {
 			log.Println("syslog channel full, skipping message")
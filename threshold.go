@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// センサーの値のしきい値アラート
+// センサーの種類(Type)、アドレス、名前または*毎に項目の上限と下限を設定して
+// duration秒以上超えた状態が続いたらアラート、hysteresis以上戻ったらclearedを送信する
+var thresholdMetrics = map[string]bool{
+	"temperature": true,
+	"humidity":    true,
+	"co2":         true,
+	"pressure":    true,
+	"battery":     true,
+	"load":        true,
+	"tvoc":        true,
+	"sound":       true,
+}
+
+// ThresholdRuleEnt : しきい値のルール
+type ThresholdRuleEnt struct {
+	Target     string   `json:"target"`
+	Metric     string   `json:"metric"`
+	High       *float64 `json:"high,omitempty"`
+	Low        *float64 `json:"low,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+	Duration   int64    `json:"duration,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+}
+
+// thresholdStateEnt : デバイスとルール毎の状態
+type thresholdStateEnt struct {
+	Level   string
+	Since   int64
+	Pending string
+	Start   int64
+}
+
+var thresholdRules []ThresholdRuleEnt
+var thresholdStateMap = make(map[string]*thresholdStateEnt)
+
+func loadThresholds(path string) {
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("load thresholds err=%v", err)
+	}
+	if err := json.Unmarshal(b, &thresholdRules); err != nil {
+		log.Fatalf("load thresholds err=%v", err)
+	}
+	for i, r := range thresholdRules {
+		r.Metric = strings.ToLower(r.Metric)
+		if r.Metric == "etvoc" {
+			r.Metric = "tvoc"
+		}
+		if !thresholdMetrics[r.Metric] || (r.High == nil && r.Low == nil) || r.Hysteresis < 0 || r.Duration < 0 {
+			log.Fatalf("invalid threshold rule=%+v", r)
+		}
+		if r.Target == "" {
+			r.Target = "*"
+		}
+		r.Severity = parseSeverity(r.Severity)
+		thresholdRules[i] = r
+	}
+	log.Printf("load thresholds=%d", len(thresholdRules))
+}
+
+// getEnvValues : 環境センサーのデコードした項目(metrics)の値
+// しきい値と変化の判定に使う(しきい値はthresholdMetricsの項目だけ判定する)
+// 受信していない項目はデコーダーが指定しないため含めない
+func getEnvValues(e *mqttEnvDataEnt, metrics ...string) map[string]float64 {
+	r := make(map[string]float64)
+	for _, m := range metrics {
+		switch m {
+		case "temperature":
+			r[m] = e.Temperature
+		case "humidity":
+			r[m] = e.Humidity
+		case "battery":
+			r[m] = float64(e.Battery)
+		case "co2":
+			r[m] = float64(e.Co2)
+		case "pressure":
+			r[m] = e.Pressure
+		case "tvoc":
+			r[m] = float64(e.TVOC)
+		case "sound":
+			r[m] = e.Sound
+		case "lux":
+			r[m] = float64(e.Lux)
+		case "pm25":
+			r[m] = float64(e.PM25)
+		case "pm10":
+			r[m] = float64(e.PM10)
+		case "discomfort":
+			r[m] = e.Discomfort
+		case "heat_stroke":
+			r[m] = e.HeatStroke
+		default:
+			log.Printf("unknown env metric=%s", m)
+		}
+	}
+	return r
+}
+
+func (r *ThresholdRuleEnt) match(d *BluetoothDeviceEnt, typ string) bool {
+	return r.Target == "*" || r.Target == typ || r.Target == d.Address || (d.Name != "" && r.Target == d.Name)
+}
+
+// checkThresholds : センサーの値をデコードした時にしきい値を判定する
+func checkThresholds(d *BluetoothDeviceEnt, typ string, values map[string]float64) {
+	now := time.Now().Unix()
+	for i := range thresholdRules {
+		r := &thresholdRules[i]
+		v, ok := values[r.Metric]
+		if !ok || !r.match(d, typ) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", d.Address, i)
+		s, ok := thresholdStateMap[key]
+		if !ok {
+			s = &thresholdStateEnt{}
+			thresholdStateMap[key] = s
+		}
+		switch s.Level {
+		case "high":
+			if v < *r.High-r.Hysteresis {
+				sendThresholdAlert(d, typ, r, "cleared", v, *r.High, now-s.Since)
+				s.Level = ""
+			}
+			continue
+		case "low":
+			if v > *r.Low+r.Hysteresis {
+				sendThresholdAlert(d, typ, r, "cleared", v, *r.Low, now-s.Since)
+				s.Level = ""
+			}
+			continue
+		}
+		level := ""
+		limit := 0.0
+		if r.High != nil && v > *r.High {
+			level = "high"
+			limit = *r.High
+		} else if r.Low != nil && v < *r.Low {
+			level = "low"
+			limit = *r.Low
+		}
+		if level == "" {
+			s.Pending = ""
+			continue
+		}
+		if s.Pending != level {
+			s.Pending = level
+			s.Start = now
+		}
+		if now-s.Start < r.Duration {
+			continue
+		}
+		s.Level = level
+		s.Since = s.Start
+		s.Pending = ""
+		sendThresholdAlert(d, typ, r, level, v, limit, now-s.Since)
+	}
+}
+
+// forgetThresholds : 削除したデバイスのしきい値の状態を削除する
+func forgetThresholds(d *BluetoothDeviceEnt) {
+	if len(thresholdStateMap) < 1 {
+		return
+	}
+	for k := range thresholdStateMap {
+		if strings.HasPrefix(k, d.Address+"/") {
+			delete(thresholdStateMap, k)
+		}
+	}
+}
+
+func sendThresholdAlert(d *BluetoothDeviceEnt, typ string, r *ThresholdRuleEnt, event string, v, limit float64, duration int64) {
+	severity := r.Severity
+	if event == "cleared" {
+		severity = "info"
+	}
+	sendAlert(&mqttAlertDataEnt{
+		Type:     "threshold",
+		Event:    event,
+		Severity: severity,
+		Address:  d.Address,
+		Name:     d.Name,
+		RSSI:     d.RSSI,
+		Sensor:   typ,
+		Metric:   r.Metric,
+		Value:    &v,
+		Limit:    &limit,
+		Duration: duration,
+	}, fmt.Sprintf(",sensor=%s,metric=%s,value=%.02f,limit=%.02f,duration=%d", typ, r.Metric, v, limit, duration))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 時間、日、週毎のユニークなデバイス数
+// アドレスを全て保持しないようにHyperLogLogで推定する(誤差は約1.6%)
+// アドレスの種類と分類毎にも集計して期間の区切りで送信する
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+type hllEnt struct {
+	reg [hllRegisters]uint8
+}
+
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// splitmix64の最終処理で下位ビットも分散させる
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hllEnt) add(s string) {
+	x := hllHash(s)
+	i := x >> (64 - hllPrecision)
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	r := uint8(bits.LeadingZeros64(w)) + 1
+	if r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+func (h *hllEnt) count() int {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.reg {
+		sum += 1.0 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(e + 0.5)
+}
+
+type UniqueWindowEnt struct {
+	Name     string
+	Start    time.Time
+	Total    *hllEnt
+	AddrType map[string]*hllEnt
+	Category map[string]*hllEnt
+}
+
+var uniqueWindows []*UniqueWindowEnt
+var lastUniqueCheck int64
+
+func parseUniqueWindows(s string) {
+	for _, w := range strings.Split(s, ",") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		if w != "hour" && w != "day" && w != "week" {
+			log.Fatalf("invalid unique window=%s", w)
+		}
+		u := &UniqueWindowEnt{Name: w}
+		u.reset(getWindowStart(w, time.Now()))
+		uniqueWindows = append(uniqueWindows, u)
+	}
+}
+
+// getWindowStart : 期間の開始日時(週は月曜日から)
+func getWindowStart(w string, t time.Time) time.Time {
+	switch w {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "week":
+		d := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-d, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func (u *UniqueWindowEnt) reset(start time.Time) {
+	u.Start = start
+	u.Total = &hllEnt{}
+	u.AddrType = make(map[string]*hllEnt)
+	u.Category = make(map[string]*hllEnt)
+}
+
+func (u *UniqueWindowEnt) add(id, addrType, category string) {
+	u.Total.add(id)
+	if _, ok := u.AddrType[addrType]; !ok {
+		u.AddrType[addrType] = &hllEnt{}
+	}
+	u.AddrType[addrType].add(id)
+	if _, ok := u.Category[category]; !ok {
+		u.Category[category] = &hllEnt{}
+	}
+	u.Category[category].add(id)
+}
+
+// checkUniqueCount : 前回以降に受信したデバイスを集計し、期間が終わったら送信する
+// 前回以降に受信したデバイスは終わった期間に含める
+func checkUniqueCount() {
+	if len(uniqueWindows) < 1 {
+		return
+	}
+	now := time.Now()
+	deviceMap.Range(func(k, v interface{}) bool {
+		d, ok := v.(*BluetoothDeviceEnt)
+		if !ok || d.LastTime < lastUniqueCheck {
+			return true
+		}
+		if d.Category == "" {
+			classifyDevice(d)
+		}
+		// 関連付けたランダムアドレスは1台として数える
+		id := getDeviceID(d)
+		if d.ChainID != "" {
+			id = d.ChainID
+		}
+		for _, u := range uniqueWindows {
+			u.add(id, d.AddressType, d.Category)
+		}
+		return true
+	})
+	lastUniqueCheck = now.Unix()
+	for _, u := range uniqueWindows {
+		if s := getWindowStart(u.Name, now); !s.Equal(u.Start) {
+			sendUniqueCount(u, s)
+			u.reset(s)
+		}
+	}
+}
+
+func getHLLCounts(m map[string]*hllEnt) (map[string]int, string) {
+	r := make(map[string]int)
+	keys := []string{}
+	for k, h := range m {
+		r[k] = h.count()
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := []string{}
+	for _, k := range keys {
+		s = append(s, fmt.Sprintf("%s:%d", k, r[k]))
+	}
+	return r, strings.Join(s, ";")
+}
+
+func sendUniqueCount(u *UniqueWindowEnt, end time.Time) {
+	total := u.Total.count()
+	at, atStr := getHLLCounts(u.AddrType)
+	cat, catStr := getHLLCounts(u.Category)
+	if debug {
+		log.Printf("unique count window=%s total=%d addrType=%s category=%s", u.Name, total, atStr, catStr)
+	}
+	sendSyslog(fmt.Sprintf("type=UniqueCount,window=%s,start=%s,end=%s,total=%d,addrType=%s,category=%s",
+		u.Name, u.Start.Format(time.RFC3339), end.Format(time.RFC3339), total, atStr, catStr))
+	publishMQTT(&mqttUniqueCountDataEnt{
+		Time:     time.Now().Format(time.RFC3339),
+		Host:     hostName,
+		Window:   u.Name,
+		Start:    u.Start.Format(time.RFC3339),
+		End:      end.Format(time.RFC3339),
+		Total:    total,
+		AddrType: at,
+		Category: cat,
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// makeUUIDToName : Bluetooth SIGのassigned numbers(service_uuids.yaml,member_uuids.yaml)から
+// 16ビットUUIDの名前のマップ(uuidToNameMap)のuuidmap.goを出力する
+// ファイルはカンマ区切りで複数指定できる
+// https://bitbucket.org/bluetooth-SIG/public/src/main/assigned_numbers/uuids/
+func makeUUIDToName() {
+	m := make(map[int64]string)
+	for _, p := range strings.Split(uuidToName, ",") {
+		readUUIDNames(strings.TrimSpace(p), m)
+	}
+	ids := []int64{}
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	fmt.Println("package main")
+	fmt.Println()
+	fmt.Println("// uuidToNameMap : Bluetooth SIGの16ビットUUIDの名前(make uuidmapで生成する)")
+	fmt.Println("var uuidToNameMap = map[uint16]string{")
+	for _, id := range ids {
+		fmt.Printf("\t0x%04x: \"%s\",\n", id, m[id])
+	}
+	fmt.Println("}")
+}
+
+func readUUIDNames(path string, m map[int64]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("make uuid to name err=%v", err)
+	}
+	defer f.Close()
+	id := int64(-1)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s.Text()), "- "))
+		if strings.HasPrefix(l, "uuid:") {
+			v := strings.TrimSpace(strings.TrimPrefix(l, "uuid:"))
+			if id, err = strconv.ParseInt(strings.TrimPrefix(strings.ToLower(v), "0x"), 16, 32); err != nil {
+				id = -1
+			}
+		} else if strings.HasPrefix(l, "name:") && id >= 0 {
+			name := strings.TrimSpace(strings.TrimPrefix(l, "name:"))
+			name = strings.Trim(name, "'\"")
+			name = strings.ReplaceAll(name, ",", ".")
+			name = strings.ReplaceAll(name, ";", ":")
+			name = strings.ReplaceAll(name, "\"", "'")
+			m[id] = name
+			id = -1
+		}
+	}
+}
+
+// isMemberUUID : Bluetooth SIGのメンバー企業に割り当てられた16ビットUUID
+func isMemberUUID(id uint16) bool {
+	return id >= 0xfc00 && id <= 0xfeff
+}
+
+// bluetoothBaseUUID : 16/32ビットUUIDを128ビットにする時のベースUUID
+var bluetoothBaseUUID = uuid.MustParse("00000000-0000-1000-8000-00805f9b34fb")
+
+// parseUUIDList : サービスUUIDのリストを文字列のリストにする
+// 16/32ビットは16進数、128ビットはUUID形式、
+// いずれもアドバタイズではリトルエンディアン
+func parseUUIDList(data []byte, size int) []string {
+	var r []string
+	for i := 0; i+size <= len(data); i += size {
+		switch size {
+		case 2:
+			r = append(r, fmt.Sprintf("%04x", uint16(data[i+1])<<8|uint16(data[i])))
+		case 4:
+			r = append(r, fmt.Sprintf("%08x", uint32(data[i+3])<<24|uint32(data[i+2])<<16|uint32(data[i+1])<<8|uint32(data[i])))
+		case 16:
+			b := make([]byte, 16)
+			for j := range b {
+				b[j] = data[i+15-j]
+			}
+			if id, err := uuid.FromBytes(b); err == nil {
+				r = append(r, shortenUUID(id))
+			}
+		}
+	}
+	return r
+}
+
+// shortenUUID : ベースUUIDから作られた128ビットUUIDは16/32ビットにする
+func shortenUUID(id uuid.UUID) string {
+	if string(id[4:]) != string(bluetoothBaseUUID[4:]) {
+		return id.String()
+	}
+	if id[0] == 0 && id[1] == 0 {
+		return fmt.Sprintf("%02x%02x", id[2], id[3])
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", id[0], id[1], id[2], id[3])
+}
+
+// getUUIDName : 16ビットUUIDの名前を取得する
+func getUUIDName(u string) string {
+	if len(u) != 4 {
+		return ""
+	}
+	id, err := strconv.ParseUint(u, 16, 16)
+	if err != nil {
+		return ""
+	}
+	return uuidToNameMap[uint16(id)]
+}
+
+// getUUIDNames : デバイスのサービスUUIDの名前
+func getUUIDNames(d *BluetoothDeviceEnt) string {
+	var names []string
+	for u := range d.UUIDMap {
+		if n := getUUIDName(u); n != "" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// getVendorFromUUID : メンバーUUIDの所有企業からベンダーを推定する
+func getVendorFromUUID(d *BluetoothDeviceEnt) string {
+	var ids []string
+	for u := range d.UUIDMap {
+		ids = append(ids, u)
+	}
+	sort.Strings(ids)
+	for _, u := range ids {
+		if len(u) != 4 {
+			continue
+		}
+		id, err := strconv.ParseUint(u, 16, 16)
+		if err != nil || !isMemberUUID(uint16(id)) {
+			continue
+		}
+		if n, ok := uuidToNameMap[uint16(id)]; ok {
+			return fmt.Sprintf("%s(uuid:%s)", n, u)
+		}
+	}
+	return ""
+}